@@ -0,0 +1,108 @@
+package minibitcask
+
+import (
+	"minibitcask/wal"
+)
+
+// Batch buffers puts and deletes and commits them at once. Its records share a
+// batch id and are followed by a finish record in the wal, a batch without the
+// finish record is discarded when the index is rebuilt.
+type Batch struct {
+	db        *DB
+	records   []*Record
+	committed bool
+}
+
+func (db *DB) NewBatch() *Batch {
+	return &Batch{db: db}
+}
+
+func (b *Batch) Put(key, value []byte) error {
+	if b.committed {
+		return ErrBatchCommitted
+	}
+	if err := b.db.checkKeyValue(key, value); err != nil {
+		return err
+	}
+
+	// key and value are written on commit, copy them in case the caller reuses them
+	key = append([]byte(nil), key...)
+	value = append([]byte(nil), value...)
+	b.records = append(b.records, NewRecord(key, value, TYPE_RECORD_PUT))
+
+	return nil
+}
+
+func (b *Batch) Delete(key []byte) error {
+	if b.committed {
+		return ErrBatchCommitted
+	}
+	if err := b.db.checkKey(key); err != nil {
+		return err
+	}
+
+	key = append([]byte(nil), key...)
+	b.records = append(b.records, NewRecord(key, []byte(""), TYPE_RECORD_DELETE))
+
+	return nil
+}
+
+func (b *Batch) Commit() error {
+	if b.committed {
+		return ErrBatchCommitted
+	}
+	if b.db.opt.readOnly {
+		return ErrReadOnly
+	}
+	b.committed = true
+
+	if len(b.records) == 0 {
+		return nil
+	}
+
+	return b.db.write(func() error {
+		return b.db.writeBatch(b.records)
+	})
+}
+
+// writeBatch writes records as one batch and applies them to the index once its
+// finish record is written. db lock must be held.
+func (db *DB) writeBatch(records []*Record) error {
+	db.batchId++
+	batchId := db.batchId
+
+	// write records to wal
+	walPositions := make([]wal.WalPos, len(records))
+	for i, r := range records {
+		r.batchId = batchId
+		if r.GetFlag() == TYPE_RECORD_PUT {
+			if err := db.compressRecord(r); err != nil {
+				return err
+			}
+			if err := db.writeBlob(r); err != nil {
+				return err
+			}
+		}
+		walPos, err := db.writeRecord(r)
+		if err != nil {
+			return err
+		}
+		walPositions[i] = walPos
+	}
+
+	// write finish record, records are valid only after it is written
+	finish := NewRecord(nil, nil, TYPE_RECORD_BATCH_FINISHED)
+	finish.batchId = batchId
+	finishPos, err := db.writeRecord(finish)
+	if err != nil {
+		return err
+	}
+	db.addDead(finishPos)
+
+	// update index
+	for i, r := range records {
+		db.indexRecord(r, walPositions[i], db.seq)
+	}
+
+	return nil
+}
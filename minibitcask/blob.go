@@ -0,0 +1,345 @@
+package minibitcask
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"minibitcask/utils"
+	"minibitcask/wal"
+	"os"
+	"time"
+)
+
+// Values of at least the blob threshold are written as records of their own to a
+// separate log of .BLOB segments. The put record in the main log holds a pointer to
+// the blob record, so merge rewrites the pointer instead of the value. Blob
+// segments are compacted on their own once enough of their values are garbage.
+const (
+	RECORD_BLOB_FLAG  uint16 = 0x80 // the value of a put record is a blob pointer
+	BLOB_POINTER_SIZE        = 20
+)
+
+// encodeBlobPointer encodes the position of a blob record as fid(4B) | offset(8B) | size(8B).
+func encodeBlobPointer(pos wal.WalPos) []byte {
+	res := make([]byte, BLOB_POINTER_SIZE)
+	binary.LittleEndian.PutUint32(res[0:4], pos.GetFileFid())
+	binary.LittleEndian.PutUint64(res[4:12], uint64(pos.GetOffset()))
+	binary.LittleEndian.PutUint64(res[12:20], uint64(pos.GetValueSize()))
+	return res
+}
+
+// recordBlob returns the position of the blob record of put record r, nil if r
+// holds its value itself.
+func recordBlob(r *Record) *wal.FilePos {
+	if pos, ok := blobPointer(r); ok {
+		return &pos
+	}
+	return nil
+}
+
+// blobPointer returns the position of the blob record of r, false if r holds its
+// value itself.
+func blobPointer(r *Record) (wal.FilePos, bool) {
+	if r.flag&RECORD_BLOB_FLAG == 0 || len(r.value) != BLOB_POINTER_SIZE {
+		return wal.FilePos{}, false
+	}
+	return decodeBlobPointer(r.value), true
+}
+
+// decodeBlobPointer decodes a blob pointer of BLOB_POINTER_SIZE bytes.
+func decodeBlobPointer(data []byte) wal.FilePos {
+	return wal.FilePos{
+		Fid:       binary.LittleEndian.Uint32(data[0:4]),
+		Offset:    int64(binary.LittleEndian.Uint64(data[4:12])),
+		ValueSize: int64(binary.LittleEndian.Uint64(data[12:20])),
+	}
+}
+
+// openBlobWal opens the blob log if blobs are enabled or written before.
+func (db *DB) openBlobWal() error {
+	fids, err := utils.GetDataFiles(db.opt.dir, wal.BLOB_FILE_EXT)
+	if err != nil {
+		return err
+	}
+	if len(fids) == 0 && (db.opt.blobThreshold <= 0 || db.opt.readOnly) {
+		return nil
+	}
+
+	db.blobWal, err = wal.OpenFileWal(&wal.Options{
+		DirPath:         db.opt.dir,
+		SegmentSize:     db.opt.maxActiveFileSize,
+		SegmentFileExt:  wal.BLOB_FILE_EXT,
+		SyncEnabled:     db.opt.syncEnable && !db.opt.groupCommit,
+		SkipCorrupted:   db.opt.skipCorrupted,
+		ReadOnly:        db.opt.readOnly,
+		KeyProvider:     db.opt.keyProvider,
+		WriteBufferSize: db.opt.writeBufferSize,
+		MmapReads:       db.opt.mmapReads,
+	})
+	return err
+}
+
+// loadBlobStats sets the stats of blob segments once the index is built. Blobs
+// not pointed to by the index are garbage.
+func (db *DB) loadBlobStats() error {
+	if db.blobWal == nil {
+		return nil
+	}
+
+	fids, err := utils.GetDataFiles(db.opt.dir, wal.BLOB_FILE_EXT)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		info, err := os.Stat(utils.GetSegmentFilePath(db.opt.dir, fid, wal.BLOB_FILE_EXT))
+		if err != nil {
+			return err
+		}
+		db.blobStats[fid] = &segmentStat{size: info.Size(), dead: info.Size()}
+	}
+
+	it := db.data.Iterator(nil, nil, false)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if pos := indexBlob(it.Value()); pos != nil {
+			if stat, ok := db.blobStats[pos.Fid]; ok {
+				stat.dead -= pos.ValueSize
+			}
+		}
+	}
+	return nil
+}
+
+// writeBlob moves the value of put record r to the blob log if it reaches the blob
+// threshold and leaves a pointer to it in r. db lock must be held.
+func (db *DB) writeBlob(r *Record) error {
+	if db.blobWal == nil || db.opt.blobThreshold <= 0 || len(r.value) < db.opt.blobThreshold {
+		return nil
+	}
+
+	// the blob is found through its pointer, so it is never part of a batch
+	blob := *r
+	blob.batchId = 0
+	pos, err := db.blobWal.Write(blob.EncodeRecord())
+	if err != nil {
+		return err
+	}
+	db.addBlobWritten(pos)
+	if db.syncer != nil {
+		db.syncer.written(pos.GetValueSize())
+	}
+
+	// the codec applies to the value in the blob
+	r.value = encodeBlobPointer(pos)
+	r.valueSize = BLOB_POINTER_SIZE
+	r.flag = r.GetFlag() | RECORD_BLOB_FLAG
+	return nil
+}
+
+// readBlob returns the record holding the value of r read at walPos, which is r
+// itself unless the value is in the blob log.
+func (db *DB) readBlob(r *Record, walPos wal.WalPos) (*Record, error) {
+	if r.flag&RECORD_BLOB_FLAG == 0 {
+		return r, nil
+	}
+
+	pos, ok := blobPointer(r)
+	if !ok || db.blobWal == nil {
+		return nil, &ErrCorruptRecord{Fid: walPos.GetFileFid(), Offset: walPos.GetOffset()}
+	}
+	data, err := db.blobWal.Read(&pos)
+	if err != nil {
+		return nil, err
+	}
+	return db.decodeRecord(data, &pos)
+}
+
+// releaseBlob counts the blob of the record at index position walPos as garbage
+// once its key is overwritten or deleted.
+func (db *DB) releaseBlob(walPos wal.WalPos) {
+	if pos := indexBlob(walPos); pos != nil {
+		db.addBlobDead(pos)
+	}
+}
+
+// isLiveBlob reports whether the blob at pos holds the value of key. db lock must be held.
+func (db *DB) isLiveBlob(key []byte, pos wal.WalPos) bool {
+	walPos := db.data.Get(key)
+	if walPos == nil {
+		return false
+	}
+	live := indexBlob(walPos)
+	return live != nil && samePos(live, pos)
+}
+
+func (db *DB) addBlobWritten(pos wal.WalPos) {
+	stat, ok := db.blobStats[pos.GetFileFid()]
+	if !ok {
+		stat = &segmentStat{}
+		db.blobStats[pos.GetFileFid()] = stat
+	}
+	stat.size += pos.GetValueSize()
+}
+
+func (db *DB) addBlobDead(pos wal.WalPos) {
+	if stat, ok := db.blobStats[pos.GetFileFid()]; ok {
+		stat.dead += pos.GetValueSize()
+	}
+}
+
+// pickBlobSegments returns the sealed blob segments whose garbage ratio reaches the
+// blob garbage ratio. If full, the active blob segment is sealed and all are returned.
+func (db *DB) pickBlobSegments(full bool) ([]uint32, error) {
+	db.rwLock.Lock()
+	defer db.rwLock.Unlock()
+
+	fids, err := utils.GetDataFiles(db.opt.dir, wal.BLOB_FILE_EXT)
+	if err != nil || len(fids) == 0 {
+		return nil, err
+	}
+
+	sealed := fids[:len(fids)-1]
+	if full {
+		// the active segment is sealed even if it only has garbage, so no segment keeps an old key
+		if stat, ok := db.blobStats[fids[len(fids)-1]]; ok && stat.size > 0 {
+			if err := db.blobWal.OpenNewActiveSegment(); err != nil {
+				return nil, err
+			}
+			sealed = fids
+		}
+	}
+
+	// blob segments read by snapshots are compacted once they are released
+	_, pinnedFid, _, pinned := db.pinnedFids()
+	ratio := db.opt.blobGarbageRatio
+	var picked []uint32
+	for _, fid := range sealed {
+		if pinned && fid <= pinnedFid {
+			continue
+		}
+		if stat, ok := db.blobStats[fid]; full || (ok && ratio > 0 && stat.dead > 0 && stat.ratio() >= ratio) {
+			picked = append(picked, fid)
+		}
+	}
+	return picked, nil
+}
+
+// compactBlobs rewrites the live blobs of the picked blob segments to the active
+// blob segment, points their keys to the new blobs and removes the segments.
+func (m *Merge) compactBlobs(ctx context.Context, full bool, stats *MergeStats) error {
+	if m.db.blobWal == nil {
+		return nil
+	}
+
+	fids, err := m.db.pickBlobSegments(full)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		if err := m.compactBlobSegment(ctx, fid, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Merge) compactBlobSegment(ctx context.Context, fid uint32, stats *MergeStats) error {
+	db := m.db
+	reader, err := db.blobWal.NewSegmentReader(fid)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var rewritten int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		data, pos, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = m.limiter.WaitN(ctx, int(pos.GetValueSize())); err != nil {
+			return err
+		}
+
+		r, err := db.decodeRecord(data, pos)
+		if err != nil {
+			if db.skipCorrupted(err) {
+				continue
+			}
+			return err
+		}
+
+		db.rwLock.RLock()
+		live := db.isLiveBlob(r.key, pos)
+		db.rwLock.RUnlock()
+		if !live || r.IsExpired(time.Now().UnixMilli()) {
+			continue
+		}
+
+		// the value is copied without db lock, its key is checked again before it is repointed
+		if err = m.limiter.WaitN(ctx, len(data)); err != nil {
+			return err
+		}
+		newPos, err := db.blobWal.Write(data)
+		if err != nil {
+			return err
+		}
+		err = db.write(func() error {
+			db.addBlobWritten(newPos)
+			if !db.isLiveBlob(r.key, pos) {
+				db.addBlobDead(newPos)
+				return nil
+			}
+
+			ptr := NewRecord(r.key, encodeBlobPointer(newPos), TYPE_RECORD_PUT|RECORD_BLOB_FLAG)
+			ptr.ts = r.ts
+			ptr.expireAt = r.expireAt
+			walPos, err := db.writeRecord(ptr)
+			if err != nil {
+				return err
+			}
+			version := indexVersion(db.data.Get(ptr.key))
+			db.indexPut(ptr.key, newIndexPos(walPos, ptr.expireAt, recordBlob(ptr), version))
+
+			rewritten += newPos.GetValueSize()
+			stats.RecordsRewritten++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// the new blobs and their pointers must be durable before the old blobs are gone
+	if err = db.blobWal.Sync(); err != nil {
+		return err
+	}
+	if err = db.wal.Sync(); err != nil {
+		return err
+	}
+
+	db.rwLock.Lock()
+	defer db.rwLock.Unlock()
+
+	// a snapshot taken meanwhile may read the old blobs, the segment is removed once
+	// it is released and the segment is picked again
+	if _, pinnedFid, _, pinned := db.pinnedFids(); pinned && fid <= pinnedFid {
+		return nil
+	}
+	if err = db.blobWal.RemoveSegment(fid); err != nil {
+		return err
+	}
+	if stat, ok := db.blobStats[fid]; ok {
+		stats.BytesReclaimed += stat.size - rewritten
+		delete(db.blobStats, fid)
+	}
+	stats.BlobSegmentsRead++
+	return nil
+}
@@ -0,0 +1,80 @@
+package minibitcask
+
+import (
+	"bytes"
+	"time"
+)
+
+// CompareAndSwap sets key to value if its current value equals expected. It
+// reports whether value was written.
+func (db *DB) CompareAndSwap(key, expected, value []byte) (bool, error) {
+	return db.writeIf(key, value, false, func(current []byte, ok bool) bool {
+		return ok && bytes.Equal(current, expected)
+	})
+}
+
+// PutIfAbsent sets key to value if key does not exist. It reports whether value
+// was written.
+func (db *DB) PutIfAbsent(key, value []byte) (bool, error) {
+	return db.writeIf(key, value, false, func(current []byte, ok bool) bool {
+		return !ok
+	})
+}
+
+// DeleteIfEquals deletes key if its current value equals expected. It reports
+// whether key was deleted.
+func (db *DB) DeleteIfEquals(key, expected []byte) (bool, error) {
+	return db.writeIf(key, nil, true, func(current []byte, ok bool) bool {
+		return ok && bytes.Equal(current, expected)
+	})
+}
+
+// writeIf puts value, or deletes key if del is set, when cond holds for the
+// current value of key. Both run under db lock, so no write comes in between.
+func (db *DB) writeIf(key, value []byte, del bool, cond func(current []byte, ok bool) bool) (bool, error) {
+	if db.opt.readOnly {
+		return false, ErrReadOnly
+	}
+	err := db.checkKeyValue(key, value)
+	if del {
+		err = db.checkKey(key)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	applied := false
+	err = db.write(func() error {
+		current, ok, err := db.currentValue(key)
+		if err != nil {
+			return err
+		}
+		if !cond(current, ok) {
+			return nil
+		}
+
+		if del {
+			err = db.writeDelete(key)
+		} else {
+			err = db.writePut(key, value, 0)
+		}
+		applied = err == nil
+		return err
+	})
+	return applied, err
+}
+
+// currentValue returns the value of key, false if it does not exist. db lock
+// must be held.
+func (db *DB) currentValue(key []byte) ([]byte, bool, error) {
+	walPos := db.data.Get(key)
+	if walPos == nil || isExpired(walPos, time.Now().UnixMilli()) {
+		return nil, false, nil
+	}
+
+	value, err := db.readValue(walPos)
+	if err == ErrKeyNotFound {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
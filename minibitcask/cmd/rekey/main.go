@@ -0,0 +1,64 @@
+// Command rekey rewrites a minibitcask db with a new encryption key through merge.
+//
+//	rekey -dir ./data -old-key <hex> -old-key-id 0 -new-key <hex> -new-key-id 1 -segment-size 1048576
+//
+// An empty old key encrypts a plain db, an empty new key decrypts it.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"log"
+	"minibitcask"
+	"minibitcask/wal"
+)
+
+func main() {
+	dir := flag.String("dir", "", "db dir")
+	oldKey := flag.String("old-key", "", "hex encoded key the db is encrypted with")
+	oldKeyId := flag.Uint("old-key-id", 0, "id of the old key")
+	newKey := flag.String("new-key", "", "hex encoded key to encrypt the db with")
+	newKeyId := flag.Uint("new-key-id", 1, "id of the new key")
+	segmentSize := flag.Int64("segment-size", minibitcask.DefaultOptions.GetMaxActiveFileSize(), "max segment size the db is written with")
+	flag.Parse()
+
+	if *dir == "" {
+		log.Fatal("dir is required")
+	}
+	if *oldKey != "" && *newKey != "" && *oldKeyId == *newKeyId {
+		log.Fatal("old and new key need different ids")
+	}
+
+	keys := make(map[uint32][]byte)
+	if *oldKey != "" {
+		key, err := hex.DecodeString(*oldKey)
+		if err != nil {
+			log.Fatalf("decode old key: %v", err)
+		}
+		keys[uint32(*oldKeyId)] = key
+	}
+	if *newKey != "" {
+		key, err := hex.DecodeString(*newKey)
+		if err != nil {
+			log.Fatalf("decode new key: %v", err)
+		}
+		keys[uint32(*newKeyId)] = key
+	}
+
+	opt := *minibitcask.DefaultOptions
+	db, err := minibitcask.Open(&opt, minibitcask.WithDir(*dir), minibitcask.WithMaxActiveFileSize(*segmentSize), minibitcask.WithMergeInteval(0),
+		minibitcask.WithKeyProvider(wal.NewStaticKeyProvider(uint32(*newKeyId), keys)))
+	if err != nil {
+		log.Fatalf("open db: %v", err)
+	}
+
+	if err = db.Rekey(); err != nil {
+		db.Close()
+		log.Fatalf("rekey: %v", err)
+	}
+	if err = db.Close(); err != nil {
+		log.Fatalf("close db: %v", err)
+	}
+
+	log.Printf("rekeyed %s\n", *dir)
+}
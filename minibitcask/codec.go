@@ -0,0 +1,98 @@
+package minibitcask
+
+import (
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression of record values. It is stored in the high byte of
+// the record flag, so records of different codecs can be read side by side.
+type Codec uint16
+
+const (
+	CODEC_NONE   Codec = 0
+	CODEC_SNAPPY Codec = 1
+	CODEC_ZSTD   Codec = 2
+)
+
+const (
+	RECORD_TYPE_MASK   uint16 = 0x3f // the top bits of the low byte are RECORD_V1_FLAG and RECORD_BLOB_FLAG
+	RECORD_CODEC_SHIFT        = 8
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd creates the shared zstd encoder and decoder, both are safe for
+// concurrent EncodeAll and DecodeAll.
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdErr
+}
+
+// compress compresses value with codec.
+func compress(codec Codec, value []byte) ([]byte, error) {
+	switch codec {
+	case CODEC_NONE:
+		return value, nil
+	case CODEC_SNAPPY:
+		return snappy.Encode(nil, value), nil
+	case CODEC_ZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(value, nil), nil
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
+
+// decompress decompresses value compressed with codec.
+func decompress(codec Codec, value []byte) ([]byte, error) {
+	switch codec {
+	case CODEC_NONE:
+		return value, nil
+	case CODEC_SNAPPY:
+		return snappy.Decode(nil, value)
+	case CODEC_ZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(value, nil)
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
+
+// compressRecord compresses the value of put record r with the codec of the db
+// if the value reaches the threshold, and keeps it raw if it does not shrink.
+func (db *DB) compressRecord(r *Record) error {
+	if db.opt.codec == CODEC_NONE || len(r.value) < db.opt.compressThreshold {
+		return nil
+	}
+
+	value, err := compress(db.opt.codec, r.value)
+	if err != nil {
+		return err
+	}
+	if len(value) >= len(r.value) {
+		return nil
+	}
+
+	r.value = value
+	r.valueSize = uint32(len(value))
+	r.flag |= uint16(db.opt.codec) << RECORD_CODEC_SHIFT
+	return nil
+}
@@ -0,0 +1,107 @@
+package minibitcask
+
+// MAX_GROUP_COMMIT_SIZE is the most writes committed with one fsync.
+const MAX_GROUP_COMMIT_SIZE = 1024
+
+type commitRequest struct {
+	fn   func() error
+	done chan error
+}
+
+// groupCommitter runs the writes of concurrent callers in one goroutine. It takes
+// all queued writes, runs them under db lock, syncs the wal once and then wakes
+// up their callers.
+type groupCommitter struct {
+	db      *DB
+	reqCh   chan *commitRequest
+	closeCh chan struct{}
+	doneCh  chan struct{}
+}
+
+func newGroupCommitter(db *DB) *groupCommitter {
+	c := &groupCommitter{
+		db:      db,
+		reqCh:   make(chan *commitRequest, MAX_GROUP_COMMIT_SIZE),
+		closeCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// commit queues fn and waits until it is run and synced.
+func (c *groupCommitter) commit(fn func() error) error {
+	req := &commitRequest{fn: fn, done: make(chan error, 1)}
+	select {
+	case c.reqCh <- req:
+	case <-c.closeCh:
+		return ErrDatabaseClosed
+	}
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-c.doneCh:
+		// committer may have stopped before it saw req
+		select {
+		case err := <-req.done:
+			return err
+		default:
+			return ErrDatabaseClosed
+		}
+	}
+}
+
+func (c *groupCommitter) run() {
+	defer close(c.doneCh)
+
+	for {
+		select {
+		case req := <-c.reqCh:
+			reqs := []*commitRequest{req}
+			// take everything queued while the last group was synced
+			for len(reqs) < MAX_GROUP_COMMIT_SIZE && len(c.reqCh) > 0 {
+				reqs = append(reqs, <-c.reqCh)
+			}
+			c.commitGroup(reqs)
+		case <-c.closeCh:
+			// writes queued before close are still committed
+			for len(c.reqCh) > 0 {
+				c.commitGroup([]*commitRequest{<-c.reqCh})
+			}
+			return
+		}
+	}
+}
+
+func (c *groupCommitter) commitGroup(reqs []*commitRequest) {
+	db := c.db
+	errs := make([]error, len(reqs))
+
+	db.rwLock.Lock()
+	for i, req := range reqs {
+		errs[i] = req.fn()
+	}
+	db.rwLock.Unlock()
+
+	// one fsync makes the whole group durable, blobs first so no pointer outlives its blob
+	var syncErr error
+	if db.blobWal != nil {
+		syncErr = db.blobWal.Sync()
+	}
+	if syncErr == nil {
+		syncErr = db.wal.Sync()
+	}
+	for i, req := range reqs {
+		if errs[i] == nil {
+			errs[i] = syncErr
+		}
+		req.done <- errs[i]
+	}
+}
+
+// close stops the committer once the queued writes are committed.
+func (c *groupCommitter) close() {
+	close(c.closeCh)
+	<-c.doneCh
+}
@@ -1,20 +1,35 @@
 package minibitcask
 
 import (
+	"context"
+	"errors"
 	"io"
+	"log"
+	"minibitcask/index"
+	"minibitcask/utils"
 	"minibitcask/wal"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/xujiajun/utils/filesystem"
 )
 
 type DB struct {
-	data	   map[string]wal.WalPos
+	data	   index.Indexer
 	wal	       wal.Wal
 	opt        *Options
 	merge      *Merge
 	rwLock     *sync.RWMutex
+	batchId    uint64 // id of the last batch written to wal
+	fileLock   *utils.FileLock
+	stats      map[uint32]*segmentStat // size and garbage of each segment
+	committer  *groupCommitter // nil if writes are not group committed
+	syncer     *syncer // nil if wal is not synced in background
+	blobWal    wal.Wal // nil if there is no blob log
+	blobStats  map[uint32]*segmentStat // size and garbage of each blob segment
+	seq        uint64 // number of records written since open
+	snapshots  map[*Snapshot]struct{} // open snapshots, their segments are not merged
 }
 
 func Open(opt *Options, ops ...Option) (*DB, error) {
@@ -23,38 +38,92 @@ func Open(opt *Options, ops ...Option) (*DB, error) {
 	}
 
 	db := &DB{
-		data:   make(map[string]wal.WalPos),
+		data:   index.NewIndexer(opt.indexType),
 		opt:    opt,
-		rwLock: &sync.RWMutex{},}
+		rwLock: &sync.RWMutex{},
+		stats:  make(map[uint32]*segmentStat),
+		blobStats: make(map[uint32]*segmentStat),
+		snapshots: make(map[*Snapshot]struct{}),}
 
 	// create dir
 	if ok := filesystem.PathIsExist(db.opt.dir); !ok {
+		if opt.readOnly {
+			return nil, wal.ErrNoSegment
+		}
 		if err := os.MkdirAll(db.opt.dir, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
+	// lock dir so that only one process writes to it, read-only processes share it
+	fileLock, ok, err := utils.TryLockFile(utils.GetLockFilePath(opt.dir), opt.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDatabaseLocked
+	}
+	db.fileLock = fileLock
+
+	// complete or discard the merge interrupted by a crash
+	if err := recoverMerge(opt.dir, opt.readOnly); err != nil {
+		fileLock.Unlock()
+		return nil, err
+	}
+
+	// values of blobs are in their own wal
+	if err := db.openBlobWal(); err != nil {
+		fileLock.Unlock()
+		return nil, err
+	}
+
 	// create data wal
 	walOptions := &wal.Options{
 		DirPath:        opt.dir,
 		SegmentSize:    opt.maxActiveFileSize,
 		SegmentFileExt: wal.SEGMENT_FILE_EXT,
-		SyncEnabled: opt.syncEnable,
+		// group commit syncs once for all writes it commits together
+		SyncEnabled: opt.syncEnable && !opt.groupCommit,
+		SkipCorrupted: opt.skipCorrupted,
+		ReadOnly: opt.readOnly,
+		KeyProvider: opt.keyProvider,
+		WriteBufferSize: opt.writeBufferSize,
+		MmapReads: opt.mmapReads,
 	}
 	wal, err := wal.OpenFileWal(walOptions)
 	if err != nil {
+		db.closeBlobWal()
+		fileLock.Unlock()
 		return nil, err
 	}
 	db.wal = wal
 
 	// build index
 	if err := db.buildIndex(); err != nil {
+		wal.Close()
+		db.closeBlobWal()
+		fileLock.Unlock()
+		return nil, err
+	}
+	if err := db.loadBlobStats(); err != nil {
+		wal.Close()
+		db.closeBlobWal()
+		fileLock.Unlock()
 		return nil, err
 	}
 
-	// start merge
-	db.merge = NewMerge(db)
-	db.merge.Start()
+	// start merge, a read-only db never changes its files
+	if !opt.readOnly {
+		if opt.syncEnable && opt.groupCommit {
+			db.committer = newGroupCommitter(db)
+		}
+		if !opt.syncEnable && (opt.syncInterval > 0 || opt.syncBytes > 0) {
+			db.syncer = newSyncer(db)
+		}
+
+		db.merge = NewMerge(db)
+		db.merge.Start()
+	}
 
 	return db, nil
 }
@@ -64,13 +133,82 @@ func (db *DB) GetOpt() *Options {
 }
 
 func (db *DB) buildIndex() error {
+	fids, err := utils.GetDataFiles(db.opt.dir, wal.SEGMENT_FILE_EXT)
+	if err != nil {
+		return err
+	}
+
+	// records of batches waiting for their finish record, which may be in a later segment
+	batches := make(map[uint64][]*batchRecord)
+	for _, fid := range fids {
+		if err := db.loadSegmentStat(fid); err != nil {
+			return err
+		}
+
+		// segments compacted by merge come with a hint file, which is much smaller to load
+		ok, err := db.loadHintFile(fid)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+
+		if err := db.loadSegment(fid, batches); err != nil {
+			return err
+		}
+	}
+
+	// batches left in the map were never finished and are discarded
+	for _, records := range batches {
+		for _, br := range records {
+			db.addDead(br.walPos)
+		}
+	}
+
+	return nil
+}
+
+// loadHintFile builds index from the hint file of segment fid. It returns false
+// if the hint file is missing or broken and the segment must be scanned instead.
+func (db *DB) loadHintFile(fid uint32) (bool, error) {
+	path := utils.GetHintFilePath(db.opt.dir, fid)
+	if ok := filesystem.PathIsExist(path); !ok {
+		return false, nil
+	}
+
+	hintRecords, err := ReadHintFile(path)
+	if err != nil {
+		log.Printf("read hint file %s error: %v, fall back to scan segment\n", path, err)
+		return false, nil
+	}
+
+	now := time.Now().UnixMilli()
+	for _, hr := range hintRecords {
+		if hr.GetExpireAt() != 0 && hr.GetExpireAt() <= uint64(now) {
+			db.indexDelete(hr.key)
+			continue
+		}
+		db.indexPut(hr.key, newIndexPos(hr.GetWalPos(), hr.GetExpireAt(), hr.GetBlob(), 0))
+	}
+
+	return true, nil
+}
+
+type batchRecord struct {
+	record *Record
+	walPos wal.WalPos
+}
+
+func (db *DB) loadSegment(fid uint32, batches map[uint64][]*batchRecord) error {
 	// get wal reader
-	reader, err := db.wal.NewWalReader(0)
+	reader, err := db.wal.NewSegmentReader(fid)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
-	// iterate all wal file and build index
+	// iterate all records in segment and build index
 	for {
 		data, walPos, err := reader.Next()
 		if err == io.EOF {
@@ -82,32 +220,184 @@ func (db *DB) buildIndex() error {
 		}
 
 		// decode data
-		record := DecodeRecord(data)
-		if record.GetFlag() != TYPE_RECORD_DELETE {
-			db.data[string(record.key)] = walPos
-		} else {
-			delete(db.data, string(record.key))
+		record, err := db.decodeRecord(data, walPos)
+		if err != nil {
+			if db.skipCorrupted(err) {
+				continue
+			}
+			return err
+		}
+
+		batchId := record.GetBatchId()
+		if batchId > db.batchId {
+			db.batchId = batchId
+		}
+
+		switch {
+		case record.GetFlag() == TYPE_RECORD_BATCH_FINISHED:
+			// batch is complete, apply all of its records, merge drops the finish record
+			for _, br := range batches[batchId] {
+				db.indexRecord(br.record, br.walPos, 0)
+			}
+			delete(batches, batchId)
+			db.addDead(walPos)
+		case batchId != 0:
+			batches[batchId] = append(batches[batchId], &batchRecord{record: record, walPos: walPos})
+		default:
+			db.indexRecord(record, walPos, 0)
 		}
 	}
 
 	return nil
 }
 
+// decodeRecord decodes the record read from walPos, it returns ErrCorruptRecord
+// if the record does not match its crc.
+func (db *DB) decodeRecord(data []byte, walPos wal.WalPos) (*Record, error) {
+	record, err := DecodeRecord(data)
+	if err != nil {
+		return nil, &ErrCorruptRecord{Fid: walPos.GetFileFid(), Offset: walPos.GetOffset()}
+	}
+	return record, nil
+}
+
+// skipCorrupted reports whether err is a corrupt record that should be skipped,
+// and logs a warning if so.
+func (db *DB) skipCorrupted(err error) bool {
+	var corrupt *ErrCorruptRecord
+	if !db.opt.skipCorrupted || !errors.As(err, &corrupt) {
+		return false
+	}
+
+	log.Printf("warning: skip %v\n", err)
+	return true
+}
+
+// indexRecord applies a put or delete record written at walPos to the index.
+// An expired put removes the key just like a delete.
+func (db *DB) indexRecord(r *Record, walPos wal.WalPos, version uint64) {
+	if r.GetFlag() == TYPE_RECORD_DELETE {
+		db.addTombstone(walPos, db.indexDelete(r.key))
+	} else if r.IsExpired(time.Now().UnixMilli()) {
+		db.indexDelete(r.key)
+	} else {
+		db.indexPut(r.key, newIndexPos(walPos, r.GetExpireAt(), recordBlob(r), version))
+	}
+}
+
+// indexPos is the index position of a record which expires, whose value is a blob
+// or which was written since open.
+type indexPos struct {
+	wal.WalPos
+	expireAt uint64        // 0 if the record never expires
+	blob     *wal.FilePos // position of the blob holding the value, nil if the record holds it
+	version  uint64        // seq of the write of the key, 0 if it was loaded on open
+}
+
+func newIndexPos(walPos wal.WalPos, expireAt uint64, blob *wal.FilePos, version uint64) wal.WalPos {
+	if expireAt == 0 && blob == nil && version == 0 {
+		return walPos
+	}
+	return &indexPos{WalPos: walPos, expireAt: expireAt, blob: blob, version: version}
+}
+
+// indexVersion returns the version of the key at index position walPos. It is
+// kept when merge moves the record, so it changes only when the key is written.
+func indexVersion(walPos wal.WalPos) uint64 {
+	if p, ok := walPos.(*indexPos); ok {
+		return p.version
+	}
+	return 0
+}
+
+// isExpired reports whether the record at index position walPos has expired at now, in unix milli.
+func isExpired(walPos wal.WalPos, now int64) bool {
+	p, ok := walPos.(*indexPos)
+	return ok && p.expireAt != 0 && p.expireAt <= uint64(now)
+}
+
+// indexBlob returns the position of the blob of the record at index position
+// walPos, nil if its value is not a blob.
+func indexBlob(walPos wal.WalPos) *wal.FilePos {
+	if p, ok := walPos.(*indexPos); ok {
+		return p.blob
+	}
+	return nil
+}
+
+func samePos(a, b wal.WalPos) bool {
+	return a.GetFileFid() == b.GetFileFid() && a.GetOffset() == b.GetOffset() && a.GetValueSize() == b.GetValueSize()
+}
+
 func (db *DB) Close() error {
-	db.merge.Close()
+	if db.merge != nil {
+		db.merge.Close()
+	}
+	if db.committer != nil {
+		db.committer.close()
+	}
+	if db.syncer != nil {
+		if err := db.syncer.close(); err != nil {
+			return err
+		}
+	}
 	if err := db.wal.Close(); err != nil {
 		return err
 	}
+	if err := db.closeBlobWal(); err != nil {
+		return err
+	}
+
+	// release dir lock
+	if err := db.fileLock.Unlock(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
 func (db *DB) GetSize() int {
-	return len(db.data)
+	db.rwLock.RLock()
+	defer db.rwLock.RUnlock()
+	return db.data.Size()
+}
+
+// TruncatedSize returns the size of the torn tail which Open dropped from the
+// active segment, 0 if it ended with a complete record.
+func (db *DB) TruncatedSize() int64 {
+	return db.wal.TruncatedSize()
 }
 
 func (db *DB) Merge() error {
-	return db.merge.beginMerge()
+	_, err := db.MergeWithContext(context.Background())
+	return err
+}
+
+// MergeWithContext compacts all sealed segments like Merge and reports what it did.
+// If ctx is done before the compacted segments are published, the merge is
+// abandoned and ctx.Err() is returned.
+func (db *DB) MergeWithContext(ctx context.Context) (MergeStats, error) {
+	if db.opt.readOnly {
+		return MergeStats{}, ErrReadOnly
+	}
+	return db.merge.beginMerge(ctx)
+}
+
+// Rekey rewrites all records into new segments encrypted with the current key of
+// the key provider, or unencrypted if there is none. Afterwards the old keys are
+// no longer needed.
+func (db *DB) Rekey() error {
+	// the active segment is still encrypted with the old key, seal it so merge rewrites it,
+	// full merge seals the active blob segment itself
+	if err := db.Rotate(); err != nil {
+		return err
+	}
+	return db.Merge()
+}
+
+// IsMerging reports whether a merge is running in the background.
+func (db *DB) IsMerging() bool {
+	return db.merge != nil && db.merge.IsMerging()
 }
 
 func (db *DB) Get(key []byte) ([]byte, error) {
@@ -116,97 +406,279 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	defer db.rwLock.RUnlock()
 
 	// Check if key exists
-	strKey := string(key)
-	if _, ok := db.data[strKey]; !ok {
+	walPos := db.data.Get(key)
+	if walPos == nil || isExpired(walPos, time.Now().UnixMilli()) {
 		return nil, ErrKeyNotFound
 	}
 
-	data, err := db.wal.Read(db.data[strKey])
+	return db.readValue(walPos)
+}
+
+// readValue reads the value of the record at walPos.
+func (db *DB) readValue(walPos wal.WalPos) ([]byte, error) {
+	data, err := db.wal.Read(walPos)
 	if err != nil {
 		return nil, err
 	}
 
 	// Decode value
-	r := DecodeRecord(data)
+	r, err := db.decodeRecord(data, walPos)
+	if err == nil {
+		r, err = db.readBlob(r, walPos)
+	}
+	if err != nil {
+		if db.skipCorrupted(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
 
-	return r.value, nil
+	return r.GetValue()
+}
+
+// View calls fn with the value of key without copying it. The value is only
+// valid until fn returns and must not be modified. fn must not write to db.
+func (db *DB) View(key []byte, fn func(value []byte) error) error {
+	db.rwLock.RLock()
+	defer db.rwLock.RUnlock()
+
+	walPos := db.data.Get(key)
+	if walPos == nil || isExpired(walPos, time.Now().UnixMilli()) {
+		return ErrKeyNotFound
+	}
+
+	err := db.wal.View(walPos, func(data []byte) error {
+		// decoded on the stack, the value points into data
+		var r Record
+		if err := r.decode(data); err != nil {
+			return &ErrCorruptRecord{Fid: walPos.GetFileFid(), Offset: walPos.GetOffset()}
+		}
+
+		if r.flag&RECORD_BLOB_FLAG == 0 {
+			return viewValue(&r, fn)
+		}
+
+		pos, ok := blobPointer(&r)
+		if !ok || db.blobWal == nil {
+			return &ErrCorruptRecord{Fid: walPos.GetFileFid(), Offset: walPos.GetOffset()}
+		}
+		return db.blobWal.View(&pos, func(data []byte) error {
+			var blob Record
+			if err := blob.decode(data); err != nil {
+				return &ErrCorruptRecord{Fid: pos.Fid, Offset: pos.Offset}
+			}
+			return viewValue(&blob, fn)
+		})
+	})
+	if err != nil && db.skipCorrupted(err) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+// viewValue calls fn with the value of r.
+func viewValue(r *Record, fn func(value []byte) error) error {
+	// compressed values have to be decompressed into a new slice
+	if r.GetCodec() != CODEC_NONE {
+		value, err := r.GetValue()
+		if err != nil {
+			return err
+		}
+		return fn(value)
+	}
+	return fn(r.value)
+}
+
+func (db *DB) closeBlobWal() error {
+	if db.blobWal == nil {
+		return nil
+	}
+	return db.blobWal.Close()
 }
 
 func (db *DB) Rotate() error {
+	if db.opt.readOnly {
+		return ErrReadOnly
+	}
+
 	db.rwLock.Lock()
 	defer db.rwLock.Unlock()
 	return db.wal.OpenNewActiveSegment()
 }
 
 func (db *DB) Put(key, value []byte) error {
-	// Acquire read/write lock
-	db.rwLock.Lock()
-	defer db.rwLock.Unlock()
+	return db.put(key, value, 0)
+}
+
+// PutWithTTL puts a key which expires after ttl. A non-positive ttl never expires.
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	var expireAt uint64
+	if ttl > 0 {
+		expireAt = uint64(time.Now().Add(ttl).UnixMilli())
+	}
+	return db.put(key, value, expireAt)
+}
+
+func (db *DB) put(key, value []byte, expireAt uint64) error {
+	if db.opt.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.checkKeyValue(key, value); err != nil {
+		return err
+	}
+
+	return db.write(func() error {
+		return db.writePut(key, value, expireAt)
+	})
+}
 
+// writePut writes a put record of key and indexes it. db lock must be held.
+func (db *DB) writePut(key, value []byte, expireAt uint64) error {
 	// Create new record
 	r := NewRecord(key, value, TYPE_RECORD_PUT)
+	r.expireAt = expireAt
+	if err := db.compressRecord(r); err != nil {
+		return err
+	}
+	if err := db.writeBlob(r); err != nil {
+		return err
+	}
 
 	// Write record to wal
-	walPos, err := db.wal.Write(r.EncodeRecord())
+	walPos, err := db.writeRecord(r)
 	if err  != nil {
 		return err
 	}
 
 	// build index
-	db.data[string(key)] = walPos
+	db.indexPut(key, newIndexPos(walPos, expireAt, recordBlob(r), db.seq))
 
 	return nil
 }
 
-func (db *DB) MergeRecord(data []byte, r *Record, walPos wal.WalPos) error {
-    // Acquire read/write lock
-    db.rwLock.Lock()
-	defer db.rwLock.Unlock()
+// checkKey checks the key of a delete. It is not held to the max key size, the
+// key may have been written before the limit was set.
+func (db *DB) checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyEmpty
+	}
+	return nil
+}
 
-	strKey := string(r.key)
-    // Check if key exists, only record in index is valid
-    if _, ok := db.data[strKey]; !ok {
-        return nil
-    }
+// checkKeyValue checks key and value against the size limits. The record of a
+// value must fit in a segment uncompressed.
+func (db *DB) checkKeyValue(key, value []byte) error {
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	if db.opt.maxKeySize > 0 && len(key) > db.opt.maxKeySize {
+		return ErrKeyTooLarge
+	}
+	if db.opt.maxValueSize > 0 && len(value) > db.opt.maxValueSize {
+		return ErrValueTooLarge
+	}
+	if int64(RECORD_HEAD_SIZE) + int64(len(key)) + int64(len(value)) > wal.MaxDataSize(db.opt.maxActiveFileSize) {
+		return ErrValueTooLarge
+	}
+	return nil
+}
 
-	indexWalPos := db.data[strKey]
-	if indexWalPos.GetFileFid() != walPos.GetFileFid() || indexWalPos.GetOffset() != walPos.GetOffset() || indexWalPos.GetValueSize() != walPos.GetValueSize() {
-		return nil
+// write runs fn, which writes to the wal and updates the index, under db lock.
+// With group commit, fn is run by the committer together with concurrent writes
+// and its records are synced when write returns.
+func (db *DB) write(fn func() error) error {
+	if db.committer != nil {
+		return db.committer.commit(fn)
 	}
 
-	// Write record to wal
-	walPos, err := db.wal.Write(data)
+	// Acquire read/write lock
+	db.rwLock.Lock()
+	defer db.rwLock.Unlock()
+	return fn()
+}
+
+// writeRecord appends r to the wal and counts it in the size of its segment.
+func (db *DB) writeRecord(r *Record) (wal.WalPos, error) {
+	walPos, err := db.wal.Write(r.EncodeRecord())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// update index
-	db.data[strKey] = walPos
+	db.addWritten(walPos)
+	db.seq++
+	if db.syncer != nil {
+		db.syncer.written(walPos.GetValueSize())
+	}
+	return walPos, nil
+}
 
-	return nil
+// filterLive returns the entries of merge whose records are still the indexed
+// ones of their keys, and the deletes of keys which do not exist.
+func (db *DB) filterLive(entries []*mergeEntry) []*mergeEntry {
+	// Acquire read lock
+	db.rwLock.RLock()
+	defer db.rwLock.RUnlock()
+
+	var live []*mergeEntry
+	for _, e := range entries {
+		// Check if key exists, only record in index is valid
+		indexWalPos := db.data.Get(e.record.key)
+		if e.record.GetFlag() == TYPE_RECORD_DELETE {
+			// a later put of the key shadows older records itself
+			if indexWalPos == nil {
+				live = append(live, e)
+			}
+			continue
+		}
+		if indexWalPos != nil && samePos(indexWalPos, e.walPos) {
+			live = append(live, e)
+		}
+	}
+
+	return live
 }
 
-func (db *DB) Delete(key []byte) error {
-	// Acquire read/write lock
+// deleteExpired removes key from index if its indexed record at walPos has expired.
+func (db *DB) deleteExpired(key []byte, walPos wal.WalPos) {
 	db.rwLock.Lock()
 	defer db.rwLock.Unlock()
 
-	// Check if key exists
-	if _, ok := db.data[string(key)]; !ok {
-		return ErrKeyNotFound
+	if indexWalPos := db.data.Get(key); indexWalPos != nil && samePos(indexWalPos, walPos) {
+		db.indexDelete(key)
+	}
+}
+
+func (db *DB) Delete(key []byte) error {
+	if db.opt.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.checkKey(key); err != nil {
+		return err
 	}
 
+	return db.write(func() error {
+		// Check if key exists
+		if walPos := db.data.Get(key); walPos == nil || isExpired(walPos, time.Now().UnixMilli()) {
+			return ErrKeyNotFound
+		}
+		return db.writeDelete(key)
+	})
+}
+
+// writeDelete writes a delete record of key and removes it from the index. db
+// lock must be held.
+func (db *DB) writeDelete(key []byte) error {
 	// Create new record
 	r := NewRecord(key, []byte(""), TYPE_RECORD_DELETE)
 
 	// write wal log
-	_, err := db.wal.Write(r.EncodeRecord())
+	walPos, err := db.writeRecord(r)
 	if err != nil {
 		return err
 	}
 
 	// Delete key from data
-	delete(db.data, string(key))
+	db.addTombstone(walPos, db.indexDelete(key))
 
 	return nil
 }
@@ -1,10 +1,23 @@
 package minibitcask
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"minibitcask/index"
+	"minibitcask/utils"
+	"minibitcask/wal"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"github.com/stretchr/testify/require"
+	"github.com/xujiajun/utils/filesystem"
 	"time"
 )
 
@@ -247,3 +260,2182 @@ func TestOpen(t *testing.T) {
 		require.Equal(t, value, dbValue)
 	}
 }
+
+func TestDB_MergeHint(t *testing.T) {
+	dir := "./test-merge-hint"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	db, err := Open(DefaultOptions, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("test%d", i))
+		value := []byte(fmt.Sprintf("testvalue%d", i))
+		require.NoError(t, db.Put(key, value))
+	}
+
+	// Delete half of the keys so that merge has something to drop
+	for i := 0; i < n / 2; i++ {
+		key := []byte(fmt.Sprintf("test%d", i))
+		require.NoError(t, db.Delete(key))
+	}
+
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	// Every compacted segment has a hint file, the last segment is the active one
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	for _, fid := range fids[:len(fids) - 1] {
+		_, err = os.Stat(utils.GetHintFilePath(dir, fid))
+		require.NoError(t, err)
+	}
+
+	check := func() {
+		db, err = Open(DefaultOptions, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000))
+		require.NoError(t, err)
+
+		require.Equal(t, n / 2, db.GetSize())
+		for i := 0; i < n / 2; i++ {
+			_, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := n / 2; i < n; i++ {
+			dbValue, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), dbValue)
+		}
+
+		require.NoError(t, db.Close())
+	}
+
+	// Reopen from hint files
+	check()
+
+	// Corrupt a hint file, Open falls back to scan its segment
+	path := utils.GetHintFilePath(dir, fids[0])
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data) / 2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0666))
+	check()
+
+	// Remove the hint file
+	require.NoError(t, os.Remove(path))
+	check()
+}
+
+func TestDB_Iterator(t *testing.T) {
+	t.Run("btree", func(t *testing.T) {
+		testDBIterator(t, index.BTreeIndex)
+	})
+	t.Run("hashmap", func(t *testing.T) {
+		testDBIterator(t, index.HashMapIndex)
+	})
+	t.Run("art", func(t *testing.T) {
+		testDBIterator(t, index.ARTIndex)
+	})
+}
+
+func testDBIterator(t *testing.T, indexType index.IndexType) {
+	dir := "./test-iterator"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	// Open mutates the options, copy them to keep DefaultOptions intact
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithIndexType(indexType))
+	require.NoError(t, err)
+	defer db.Close()
+
+	n := 100
+	for _, tenant := range []string{"a", "b", "c"} {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("%s-%03d", tenant, i))
+			value := []byte(fmt.Sprintf("value-%s-%03d", tenant, i))
+			require.NoError(t, db.Put(key, value))
+		}
+	}
+	require.NoError(t, db.Delete([]byte("b-050")))
+
+	collect := func(it *Iterator) []string {
+		var keys []string
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		return keys
+	}
+
+	// Prefix scan in key order
+	it := db.NewIterator(IteratorOptions{Prefix: []byte("b-")})
+	keys := collect(it)
+	require.Equal(t, n - 1, len(keys))
+	require.Equal(t, "b-000", keys[0])
+	require.Equal(t, "b-099", keys[len(keys) - 1])
+	require.NotContains(t, keys, "b-050")
+	it.Close()
+
+	// Reverse prefix scan
+	it = db.NewIterator(IteratorOptions{Prefix: []byte("c-"), Reverse: true})
+	keys = collect(it)
+	require.Equal(t, n, len(keys))
+	require.Equal(t, "c-099", keys[0])
+	require.Equal(t, "c-000", keys[len(keys) - 1])
+	it.Close()
+
+	// Range scan across prefixes
+	it = db.NewIterator(IteratorOptions{Start: []byte("a-090"), End: []byte("b-010")})
+	keys = collect(it)
+	require.Equal(t, 20, len(keys))
+	require.Equal(t, "a-090", keys[0])
+	require.Equal(t, "b-009", keys[len(keys) - 1])
+	it.Close()
+
+	// Seek, Prev and Value
+	it = db.NewIterator(IteratorOptions{Prefix: []byte("a-")})
+	it.Seek([]byte("a-0405"))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("a-041"), it.Key())
+	value, err := it.Value()
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-a-041"), value)
+	it.Prev()
+	require.Equal(t, []byte("a-040"), it.Key())
+	it.Seek([]byte("b-"))
+	require.False(t, it.Valid())
+	it.Close()
+
+	it = db.NewIterator(IteratorOptions{Prefix: []byte("a-"), Reverse: true})
+	it.Seek([]byte("a-0405"))
+	require.True(t, it.Valid())
+	require.Equal(t, []byte("a-040"), it.Key())
+	it.Next()
+	require.Equal(t, []byte("a-039"), it.Key())
+	it.Close()
+
+	// Moving across chunks in both directions
+	it = db.NewIterator(IteratorOptions{})
+	it.Seek([]byte("b-"))
+	it.Prev()
+	require.Equal(t, []byte("a-099"), it.Key())
+	it.Next()
+	require.Equal(t, []byte("b-000"), it.Key())
+	it.Close()
+
+	// A full scan reads all chunks and does not see keys written meanwhile
+	it = db.NewIterator(IteratorOptions{})
+	count := 0
+	for ; it.Valid(); it.Next() {
+		if count == 0 {
+			require.NoError(t, db.Put([]byte("c-100"), []byte("value-c-100")))
+		}
+		count++
+	}
+	require.Equal(t, 3 * n - 1, count)
+	it.Close()
+}
+
+func TestDB_Batch(t *testing.T) {
+	dir := "./test-batch"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	db, err := Open(DefaultOptions, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1))
+	require.NoError(t, err)
+
+	require.NoError(t, db.Put([]byte("user:1"), []byte("old")))
+	require.NoError(t, db.Put([]byte("email:old@example.com"), []byte("user:1")))
+
+	// Update a record and its secondary keys together
+	batch := db.NewBatch()
+	require.NoError(t, batch.Put([]byte("user:1"), []byte("new")))
+	require.NoError(t, batch.Delete([]byte("email:old@example.com")))
+	require.NoError(t, batch.Put([]byte("email:new@example.com"), []byte("user:1")))
+
+	// Nothing is visible before commit
+	value, err := db.Get([]byte("user:1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), value)
+
+	require.NoError(t, batch.Commit())
+	require.Equal(t, ErrBatchCommitted, batch.Put([]byte("user:2"), []byte("new")))
+
+	// Simulate a crash in the middle of a batch: records without finish record
+	for _, key := range []string{"user:1", "user:2"} {
+		r := NewRecord([]byte(key), []byte("torn"), TYPE_RECORD_PUT)
+		r.batchId = db.batchId + 1
+		_, err = db.wal.Write(r.EncodeRecord())
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(DefaultOptions, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1))
+	require.NoError(t, err)
+
+	value, err = db.Get([]byte("user:1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), value)
+	_, err = db.Get([]byte("email:old@example.com"))
+	require.Equal(t, ErrKeyNotFound, err)
+	value, err = db.Get([]byte("email:new@example.com"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("user:1"), value)
+	_, err = db.Get([]byte("user:2"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// Batch ids keep growing after reopen, past the unfinished batch
+	require.Equal(t, uint64(2), db.batchId)
+
+	require.NoError(t, db.Close())
+}
+
+func TestDB_PutWithTTL(t *testing.T) {
+	dir := "./test-ttl"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	db, err := Open(DefaultOptions, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+
+	n := 100
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("session%03d", i))
+		value := []byte(fmt.Sprintf("sessionvalue%d", i))
+		// Even keys expire soon, odd keys live long
+		ttl := time.Hour
+		if i % 2 == 0 {
+			ttl = time.Millisecond * 200
+		}
+		require.NoError(t, db.PutWithTTL(key, value, ttl))
+	}
+
+	value, err := db.Get([]byte("session000"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("sessionvalue0"), value)
+
+	time.Sleep(time.Millisecond * 300)
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("session%03d", i))
+			value, err := db.Get(key)
+			if i % 2 == 0 {
+				require.Equal(t, ErrKeyNotFound, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("sessionvalue%d", i)), value)
+			}
+		}
+
+		// Iterator skips expired keys
+		it := db.NewIterator(IteratorOptions{Prefix: []byte("session")})
+		count := 0
+		for ; it.Valid(); it.Next() {
+			count++
+		}
+		it.Close()
+		require.Equal(t, n / 2, count)
+	}
+	check()
+	require.Equal(t, ErrKeyNotFound, db.Delete([]byte("session000")))
+
+	// Expired keys are skipped when the index is rebuilt
+	require.NoError(t, db.Close())
+	db, err = Open(DefaultOptions, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	require.Equal(t, n / 2, db.GetSize())
+	check()
+
+	// An expired put hides the older value of its key
+	require.NoError(t, db.Put([]byte("session001"), []byte("old")))
+	require.NoError(t, db.PutWithTTL([]byte("session001"), []byte("new"), time.Millisecond * 100))
+	time.Sleep(time.Millisecond * 200)
+	_, err = db.Get([]byte("session001"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, db.Put([]byte("session001"), []byte("sessionvalue1")))
+
+	// Merge drops expired keys, also from the index
+	require.NoError(t, db.PutWithTTL([]byte("session-short"), []byte("value"), time.Millisecond * 100))
+	time.Sleep(time.Millisecond * 200)
+	require.NoError(t, db.Merge())
+	require.Equal(t, n / 2, db.GetSize())
+	check()
+
+	require.NoError(t, db.Close())
+	db, err = Open(DefaultOptions, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	check()
+	require.NoError(t, db.Close())
+}
+
+func TestDB_CorruptRecord(t *testing.T) {
+	dir := "./test-corrupt"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1024))
+	require.NoError(t, err)
+
+	n := 10
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("test%d", i))
+		value := []byte(fmt.Sprintf("testvalue%d", i))
+		require.NoError(t, db.Put(key, value))
+	}
+	require.NoError(t, db.Close())
+
+	// Flip a value byte of the first record and fix up the crc of its wal frame,
+	// so that only the record crc catches it
+	path := utils.GetSegmentFilePath(dir, 0, wal.SEGMENT_FILE_EXT)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	frameSize := binary.BigEndian.Uint32(data[4:8])
+	data[8 + frameSize - 1] ^= 0xff
+	binary.BigEndian.PutUint32(data[0:4], crc32.ChecksumIEEE(data[8:8 + frameSize]))
+	require.NoError(t, os.WriteFile(path, data, 0666))
+
+	// Fail hard by default
+	opt = *DefaultOptions
+	_, err = Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1024))
+	var corrupt *ErrCorruptRecord
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, uint32(0), corrupt.Fid)
+	require.Equal(t, int64(0), corrupt.Offset)
+
+	// Skip the corrupt record if asked to
+	opt = *DefaultOptions
+	db, err = Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1024), WithSkipCorrupted(true))
+	require.NoError(t, err)
+	_, err = db.Get([]byte("test0"))
+	require.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < n; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+	}
+	require.NoError(t, db.Close())
+}
+
+func TestDB_TornWrite(t *testing.T) {
+	dir := "./test-torn"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1024))
+	require.NoError(t, err)
+
+	n := 10
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("test%d", i))
+		value := []byte(fmt.Sprintf("testvalue%d", i))
+		require.NoError(t, db.Put(key, value))
+	}
+	require.NoError(t, db.Close())
+
+	path := utils.GetSegmentFilePath(dir, 0, wal.SEGMENT_FILE_EXT)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	size := len(data)
+
+	reopen := func(ops ...Option) (*DB, error) {
+		opt := *DefaultOptions
+		return Open(&opt, append([]Option{WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1024)}, ops...)...)
+	}
+	check := func(db *DB, from int) {
+		for i := from; i < n; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+		}
+	}
+
+	for _, tail := range [][]byte{
+		// partial header
+		{0x01, 0x02, 0x03},
+		// header of a frame whose data is cut off
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x64, 0x01, 0x02},
+		// full size frame with data that does not match its crc
+		append([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04}, 0x01, 0x02, 0x03, 0x04),
+	} {
+		require.NoError(t, os.WriteFile(path, append(append([]byte(nil), data...), tail...), 0666))
+
+		db, err = reopen()
+		require.NoError(t, err)
+		require.Equal(t, int64(len(tail)), db.TruncatedSize())
+		check(db, 0)
+
+		// writes continue right after the last valid frame
+		require.NoError(t, db.Put([]byte("after"), []byte("torn")))
+		require.NoError(t, db.Close())
+
+		db, err = reopen()
+		require.NoError(t, err)
+		require.Equal(t, int64(0), db.TruncatedSize())
+		value, err := db.Get([]byte("after"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("torn"), value)
+		check(db, 0)
+		require.NoError(t, db.Close())
+	}
+
+	// A corrupt frame in the middle is still an error
+	corrupted := append([]byte(nil), data[:size]...)
+	corrupted[8] ^= 0xff
+	require.NoError(t, os.WriteFile(path, corrupted, 0666))
+	_, err = reopen()
+	require.Equal(t, wal.ErrCrcNotMatch, err)
+
+	// unless corrupt frames are skipped
+	db, err = reopen(WithSkipCorrupted(true))
+	require.NoError(t, err)
+	_, err = db.Get([]byte("test0"))
+	require.Equal(t, ErrKeyNotFound, err)
+	check(db, 1)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_Lock(t *testing.T) {
+	dir := "./test-lock"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false))
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+
+	// A second writer is rejected while the db is open
+	opt2 := *DefaultOptions
+	_, err = Open(&opt2, WithDir(dir), WithSyncEnable(false))
+	require.Equal(t, ErrDatabaseLocked, err)
+
+	require.NoError(t, db.Close())
+
+	// and can open it once it is closed
+	opt2 = *DefaultOptions
+	db, err = Open(&opt2, WithDir(dir), WithSyncEnable(false))
+	require.NoError(t, err)
+	value, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_ReadOnly(t *testing.T) {
+	dir := "./test-read-only"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func(ops ...Option) (*DB, error) {
+		opt := *DefaultOptions
+		return Open(&opt, append([]Option{WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1)}, ops...)...)
+	}
+
+	// Nothing to read yet
+	_, err := openDB(WithReadOnly(true))
+	require.Error(t, err)
+
+	db, err := openDB()
+	require.NoError(t, err)
+	n := 100
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("test%d", i))
+		value := []byte(fmt.Sprintf("testvalue%d", i))
+		require.NoError(t, db.Put(key, value))
+	}
+
+	// Readers wait for the writer to close
+	_, err = openDB(WithReadOnly(true))
+	require.Equal(t, ErrDatabaseLocked, err)
+	require.NoError(t, db.Close())
+
+	// Leave a torn tail, read-only open must not truncate it
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	path := utils.GetSegmentFilePath(dir, fids[len(fids) - 1], wal.SEGMENT_FILE_EXT)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = fd.Write([]byte{0x01, 0x02, 0x03})
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// Several readers at the same time
+	reader1, err := openDB(WithReadOnly(true))
+	require.NoError(t, err)
+	reader2, err := openDB(WithReadOnly(true))
+	require.NoError(t, err)
+
+	for _, reader := range []*DB{reader1, reader2} {
+		for i := 0; i < n; i++ {
+			value, err := reader.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+		}
+
+		require.Equal(t, ErrReadOnly, reader.Put([]byte("key"), []byte("value")))
+		require.Equal(t, ErrReadOnly, reader.Delete([]byte("test0")))
+		require.Equal(t, ErrReadOnly, reader.Merge())
+		batch := reader.NewBatch()
+		require.NoError(t, batch.Put([]byte("key"), []byte("value")))
+		require.Equal(t, ErrReadOnly, batch.Commit())
+	}
+
+	// Writers wait for the readers to close
+	_, err = openDB()
+	require.Equal(t, ErrDatabaseLocked, err)
+
+	require.NoError(t, reader1.Close())
+	require.NoError(t, reader2.Close())
+
+	newStat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, stat.Size(), newStat.Size())
+}
+
+func TestDB_MergeRecover(t *testing.T) {
+	dir := "./test-merge-recover"
+	crashDir := "./test-merge-recover-crash"
+	defer func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(crashDir)
+	}()
+
+	openDB := func(dir string, ops ...Option) (*DB, error) {
+		opt := *DefaultOptions
+		return Open(&opt, append([]Option{WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000)}, ops...)...)
+	}
+
+	copyFile := func(src string, dst string) {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, data, 0666))
+	}
+
+	db, err := openDB(dir)
+	require.NoError(t, err)
+	n := 200
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("newvalue%d", i))))
+	}
+	for i := 0; i < n / 4; i++ {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("test%d", i))))
+	}
+	require.NoError(t, db.Close())
+
+	// Keep the segments as they were before merge
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(crashDir, os.ModePerm))
+	for _, fid := range fids {
+		copyFile(utils.GetSegmentFilePath(dir, fid, wal.SEGMENT_FILE_EXT), utils.GetSegmentFilePath(crashDir, fid, wal.SEGMENT_FILE_EXT))
+	}
+	maxFid := fids[len(fids) - 1]
+
+	db, err = openDB(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	check := func() {
+		db, err := openDB(crashDir)
+		require.NoError(t, err)
+		require.Equal(t, n - n / 4, db.GetSize())
+		for i := 0; i < n / 4; i++ {
+			_, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := n / 4; i < n; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("newvalue%d", i)), value)
+		}
+		require.NoError(t, db.Close())
+		require.False(t, filesystem.PathIsExist(utils.GetMergeDir(crashDir)))
+	}
+
+	// Merge died before its finish marker, the merge dir is discarded
+	mergeDir := utils.GetMergeDir(crashDir)
+	require.NoError(t, os.MkdirAll(mergeDir, os.ModePerm))
+	require.NoError(t, os.WriteFile(utils.GetSegmentFilePath(mergeDir, 0, wal.SEGMENT_FILE_EXT), []byte("garbage"), 0666))
+	check()
+
+	// Merge died while publishing, the first segment is already moved. Compacted
+	// segments get new fids, the last segment is the active one opened by merge
+	mergedFids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(mergeDir, os.ModePerm))
+	var published []uint32
+	for _, fid := range mergedFids[:len(mergedFids) - 1] {
+		require.Greater(t, fid, maxFid)
+		copyFile(utils.GetSegmentFilePath(dir, fid, wal.SEGMENT_FILE_EXT), utils.GetSegmentFilePath(mergeDir, fid, wal.SEGMENT_FILE_EXT))
+		copyFile(utils.GetHintFilePath(dir, fid), utils.GetHintFilePath(mergeDir, fid))
+		published = append(published, fid)
+	}
+	require.NoError(t, writeMergeFin(mergeDir, fids[0], maxFid, published))
+	require.NoError(t, moveMergeFiles(crashDir, mergeDir, published[0]))
+
+	_, err = openDB(crashDir, WithReadOnly(true))
+	require.Equal(t, ErrMergeUnfinished, err)
+
+	check()
+	crashFids, err := utils.GetDataFiles(crashDir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	require.Equal(t, published, crashFids)
+}
+
+func TestDB_MergeGarbageRatio(t *testing.T) {
+	dir := "./test-merge-garbage"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func() *DB {
+		opt := *DefaultOptions
+		// merges are run by the test only
+		db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(0), WithSegmentGarbageRatio(0.5))
+		require.NoError(t, err)
+		return db
+	}
+
+	db := openDB()
+	require.NoError(t, db.Put([]byte("deleted"), []byte("value")))
+	n := 100
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+
+	// The delete lands in a segment which then turns into garbage
+	require.NoError(t, db.Delete([]byte("deleted")))
+	for round := 0; round < 2; round++ {
+		for i := 0; i < n; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("filler%d", i)), []byte(fmt.Sprintf("fillervalue%d-%d", i, round))))
+		}
+	}
+
+	// Nothing to merge while there is no garbage
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	require.Empty(t, db.pickMergeRuns(fids[:1]))
+	first, err := os.ReadFile(utils.GetSegmentFilePath(dir, fids[0], wal.SEGMENT_FILE_EXT))
+	require.NoError(t, err)
+
+	runs := db.pickMergeRuns(fids)
+	require.NotEmpty(t, runs)
+	require.NotEqual(t, fids[0], runs[0][0])
+
+	_, err = db.merge.merge(context.Background(), false)
+	require.NoError(t, err)
+
+	// Segments with live data are left alone
+	data, err := os.ReadFile(utils.GetSegmentFilePath(dir, fids[0], wal.SEGMENT_FILE_EXT))
+	require.NoError(t, err)
+	require.Equal(t, first, data)
+
+	newFids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	require.Less(t, len(newFids), len(fids))
+
+	check := func(db *DB) {
+		_, err := db.Get([]byte("deleted"))
+		require.Equal(t, ErrKeyNotFound, err)
+		for i := 0; i < n; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+
+			value, err = db.Get([]byte(fmt.Sprintf("filler%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("fillervalue%d-1", i)), value)
+		}
+	}
+
+	check(db)
+	require.Empty(t, db.pickMergeRuns(newFids[:len(newFids) - 1]))
+	require.NoError(t, db.Close())
+
+	// The delete is kept by merge since the segment of the deleted record is not merged
+	db = openDB()
+	check(db)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_MergeTombstones(t *testing.T) {
+	dir := "./test-merge-tombstones"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func() *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000))
+		require.NoError(t, err)
+		return db
+	}
+
+	db := openDB()
+	n := 200
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+	require.NoError(t, db.Put([]byte("kept"), []byte("value")))
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+
+	// Deletes push segments over the garbage ratio, merge runs without waiting for its
+	// interval and drops the segments of deletes once the deleted records are gone
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("test%d", i))))
+	}
+	require.Eventually(t, func() bool {
+		if db.IsMerging() {
+			return false
+		}
+		newFids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+		require.NoError(t, err)
+		return len(newFids) <= 2 && newFids[0] > fids[len(fids) - 1]
+	}, time.Second * 5, time.Millisecond * 10)
+
+	check := func(db *DB) {
+		require.Equal(t, 1, db.GetSize())
+		value, err := db.Get([]byte("kept"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+		for i := 0; i < n; i++ {
+			_, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	db = openDB()
+	check(db)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_MergeShrinkSegments(t *testing.T) {
+	dir := "./test-merge-shrink"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func(segmentSize int64) *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(segmentSize), WithMergeInteval(time.Second * 6000))
+		require.NoError(t, err)
+		return db
+	}
+
+	db := openDB(1024 * 4)
+	n := 300
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+
+	// A batch spans several segments, a run starting in its middle takes in its first segment
+	batch := db.NewBatch()
+	for i := 0; i < n; i++ {
+		require.NoError(t, batch.Put([]byte(fmt.Sprintf("batch%d", i)), []byte(fmt.Sprintf("batchvalue%d", i))))
+	}
+	require.NoError(t, batch.Commit())
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	runs, err := db.merge.extendRuns(fids, [][]uint32{{fids[len(fids) - 2]}})
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	require.Less(t, runs[0][0], fids[len(fids) - 2])
+	require.NoError(t, db.Close())
+
+	// Merged records need more segments than they had before
+	db = openDB(1024 * 1)
+	require.NoError(t, db.Merge())
+
+	check := func(db *DB) {
+		require.Equal(t, 2 * n, db.GetSize())
+		for i := 0; i < n; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+
+			value, err = db.Get([]byte(fmt.Sprintf("batch%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("batchvalue%d", i)), value)
+		}
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	newFids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	require.Greater(t, len(newFids), len(fids))
+	require.Greater(t, newFids[0], fids[len(fids) - 1])
+
+	db = openDB(1024 * 1)
+	check(db)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_MergeWithContext(t *testing.T) {
+	dir := "./test-merge-context"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(0))
+	require.NoError(t, err)
+	defer db.Close()
+
+	n := 200
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+	for i := 0; i < n / 2; i++ {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("test%d", i))))
+	}
+
+	// A canceled merge leaves everything as it was
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.MergeWithContext(ctx)
+	require.Equal(t, context.Canceled, err)
+	require.False(t, filesystem.PathIsExist(utils.GetMergeDir(dir)))
+	require.False(t, db.IsMerging())
+	for _, fid := range fids {
+		require.True(t, filesystem.PathIsExist(utils.GetSegmentFilePath(dir, fid, wal.SEGMENT_FILE_EXT)))
+	}
+
+	// the canceled merge may have rotated the active segment
+	fids, err = utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+
+	stats, err := db.MergeWithContext(context.Background())
+	require.NoError(t, err)
+	require.False(t, db.IsMerging())
+	require.Equal(t, len(fids), stats.SegmentsRead)
+	require.Equal(t, n / 2, stats.RecordsRewritten)
+	require.Greater(t, stats.BytesReclaimed, int64(0))
+	require.Greater(t, stats.Duration, time.Duration(0))
+
+	for i := n / 2; i < n; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+	}
+}
+
+func TestDB_MergeRateLimit(t *testing.T) {
+	dir := "./test-merge-rate-limit"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func(rate int64) *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000), WithMergeRateLimit(rate))
+		require.NoError(t, err)
+		return db
+	}
+
+	db := openDB(0)
+	n := 400
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+	for i := 0; i < n / 2; i++ {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("test%d", i))))
+	}
+	require.NoError(t, db.Close())
+
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	size, err := segmentsSize(dir, fids)
+	require.NoError(t, err)
+
+	// A slow merge gives up once its context is done
+	db = openDB(size / 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 100)
+	defer cancel()
+	_, err = db.MergeWithContext(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.NoError(t, db.Close())
+
+	// Reading everything at size per second leaves the live records to wait for
+	db = openDB(size)
+	stats, err := db.MergeWithContext(context.Background())
+	require.NoError(t, err)
+	require.Greater(t, stats.Duration, time.Millisecond * 200)
+
+	for i := n / 2; i < n; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+	}
+	require.NoError(t, db.Close())
+}
+
+func TestDB_Compression(t *testing.T) {
+	for _, codec := range []Codec{CODEC_SNAPPY, CODEC_ZSTD} {
+		t.Run(fmt.Sprintf("codec%d", codec), func(t *testing.T) {
+			testDBCompression(t, codec)
+		})
+	}
+}
+
+func testDBCompression(t *testing.T, codec Codec) {
+	dir := "./test-compression"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func(codec Codec) *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMergeInteval(time.Second * 6000), WithCodec(codec), WithCompressThreshold(64))
+		require.NoError(t, err)
+		return db
+	}
+
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id": %d, "name": "name%d", "tags": ["a", "b", "c"], "description": "a value which repeats, a value which repeats"}`, i, i))
+	}
+
+	db := openDB(codec)
+	n := 100
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), value(i)))
+	}
+	batch := db.NewBatch()
+	require.NoError(t, batch.Put([]byte("batch"), value(n)))
+	require.NoError(t, batch.Commit())
+	// Values below the threshold are stored raw
+	require.NoError(t, db.Put([]byte("small"), []byte("small")))
+	require.NoError(t, db.Close())
+
+	// Old records stay readable after the codec is changed
+	db = openDB(CODEC_NONE)
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("raw%d", i)), value(i)))
+	}
+
+	check := func(db *DB) {
+		for i := 0; i < n; i++ {
+			dbValue, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, value(i), dbValue)
+
+			dbValue, err = db.Get([]byte(fmt.Sprintf("raw%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, value(i), dbValue)
+		}
+
+		dbValue, err := db.Get([]byte("batch"))
+		require.NoError(t, err)
+		require.Equal(t, value(n), dbValue)
+
+		dbValue, err = db.Get([]byte("small"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("small"), dbValue)
+	}
+	check(db)
+
+	// Compressed records take less space than raw ones
+	walPos := db.data.Get([]byte("test0"))
+	rawPos := db.data.Get([]byte("raw0"))
+	require.Less(t, walPos.GetValueSize(), rawPos.GetValueSize())
+
+	// Merge keeps records compressed
+	require.NoError(t, db.Merge())
+	check(db)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_Encryption(t *testing.T) {
+	dir := "./test-encryption"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func(ops ...Option) (*DB, error) {
+		opt := *DefaultOptions
+		return Open(&opt, append([]Option{WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000)}, ops...)...)
+	}
+
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+
+	db, err := openDB(WithEncryptionKey(oldKey))
+	require.NoError(t, err)
+	n := 100
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("secretvalue%d", i))))
+	}
+	for i := 0; i < n / 2; i++ {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("test%d", i))))
+	}
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	// Neither values nor keys are stored in plain
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	for _, fid := range fids {
+		data, err := os.ReadFile(utils.GetSegmentFilePath(dir, fid, wal.SEGMENT_FILE_EXT))
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "secretvalue")
+		require.NotContains(t, string(data), "test")
+		require.False(t, filesystem.PathIsExist(utils.GetHintFilePath(dir, fid)))
+	}
+
+	check := func(db *DB) {
+		for i := 0; i < n / 2; i++ {
+			_, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := n / 2; i < n; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("secretvalue%d", i)), value)
+		}
+		require.NoError(t, db.Close())
+	}
+
+	_, err = openDB()
+	require.ErrorIs(t, err, wal.ErrEncryptionKey)
+	_, err = openDB(WithEncryptionKey(newKey))
+	require.Error(t, err)
+
+	db, err = openDB(WithEncryptionKey(oldKey))
+	require.NoError(t, err)
+	check(db)
+
+	// Rekey rewrites everything with the new key
+	db, err = openDB(WithKeyProvider(wal.NewStaticKeyProvider(1, map[uint32][]byte{0: oldKey, 1: newKey})))
+	require.NoError(t, err)
+	require.NoError(t, db.Rekey())
+	require.NoError(t, db.Close())
+
+	_, err = openDB(WithEncryptionKey(oldKey))
+	require.ErrorIs(t, err, wal.ErrEncryptionKey)
+	db, err = openDB(WithKeyProvider(wal.NewStaticKeyProvider(1, map[uint32][]byte{1: newKey})))
+	require.NoError(t, err)
+	check(db)
+}
+
+func TestDB_RekeyPlaintext(t *testing.T) {
+	dir := "./test-rekey-plaintext"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	openDB := func(ops ...Option) *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, append([]Option{WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000)}, ops...)...)
+		require.NoError(t, err)
+		return db
+	}
+
+	// Every record is live, encrypted records need more segments than plain ones
+	db := openDB()
+	n := 200
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("secretvalue%d", i))))
+	}
+	require.NoError(t, db.Close())
+
+	check := func(db *DB) {
+		require.Equal(t, n, db.GetSize())
+		for i := 0; i < n; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("secretvalue%d", i)), value)
+		}
+	}
+
+	db = openDB(WithEncryptionKey(key))
+	require.NoError(t, db.Rekey())
+	check(db)
+	require.NoError(t, db.Close())
+
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	for _, fid := range fids {
+		data, err := os.ReadFile(utils.GetSegmentFilePath(dir, fid, wal.SEGMENT_FILE_EXT))
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "secretvalue")
+	}
+
+	// A torn tail of the active segment was sealed with the nonce of the next write,
+	// which goes to a new segment instead
+	db = openDB(WithEncryptionKey(key))
+	require.NoError(t, db.Put([]byte("torn"), []byte("secretvalue")))
+	activeFid := db.wal.ActiveFid()
+	require.NoError(t, db.Close())
+	path := utils.GetSegmentFilePath(dir, activeFid, wal.SEGMENT_FILE_EXT)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data[:len(data) - 3], 0666))
+
+	db = openDB(WithEncryptionKey(key))
+	require.Equal(t, activeFid, db.wal.ActiveFid())
+	check(db)
+	require.NoError(t, db.Put([]byte("next"), []byte("secretvalue")))
+	require.Greater(t, db.wal.ActiveFid(), activeFid)
+	require.NoError(t, db.Close())
+
+	db = openDB(WithEncryptionKey(key))
+	_, err = db.Get([]byte("torn"))
+	require.Equal(t, ErrKeyNotFound, err)
+	value, err := db.Get([]byte("next"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("secretvalue"), value)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_TornSegmentHeader(t *testing.T) {
+	dir := "./test-torn-header"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	openDB := func() *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithEncryptionKey(key), WithMergeInteval(time.Second * 6000))
+		require.NoError(t, err)
+		return db
+	}
+
+	db := openDB()
+	require.NoError(t, db.Put([]byte("test"), []byte("secretvalue")))
+	activeFid := db.wal.ActiveFid()
+	require.NoError(t, db.Close())
+
+	// The process died while writing the header of the next segment
+	path := utils.GetSegmentFilePath(dir, activeFid + 1, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, os.WriteFile(path, []byte(wal.SEGMENT_MAGIC + "\x00\x00"), 0666))
+
+	db = openDB()
+	require.Equal(t, activeFid + 1, db.wal.ActiveFid())
+	require.NoError(t, db.Put([]byte("next"), []byte("PLAINTEXTSECRET")))
+	require.NoError(t, db.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "PLAINTEXTSECRET")
+
+	db = openDB()
+	for key, expected := range map[string]string{"test": "secretvalue", "next": "PLAINTEXTSECRET"} {
+		value, err := db.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte(expected), value)
+	}
+	require.NoError(t, db.Close())
+}
+
+// syncCounter counts the syncs of the wal it wraps, each of them takes delay
+// like on a slow disk.
+type syncCounter struct {
+	wal.Wal
+	syncs int64
+	delay time.Duration
+}
+
+func (c *syncCounter) Sync() error {
+	atomic.AddInt64(&c.syncs, 1)
+	time.Sleep(c.delay)
+	return c.Wal.Sync()
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	dir := "./test-group-commit"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func() *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, WithDir(dir), WithSyncEnable(true), WithGroupCommit(true), WithMaxActiveFileSize(1024 * 4), WithMergeInteval(time.Second * 6000))
+		require.NoError(t, err)
+		return db
+	}
+
+	// Count the fsyncs of the wal, which does not sync writes itself under group commit
+	db := openDB()
+	counter := &syncCounter{Wal: db.wal, delay: time.Millisecond}
+	db.wal = counter
+	workers, n := 16, 50
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprintf("test%d-%d", w, i))
+				if err := db.Put(key, []byte(fmt.Sprintf("testvalue%d-%d", w, i))); err != nil {
+					errCh <- err
+					return
+				}
+				if i % 2 == 0 {
+					if err := db.Delete(key); err != nil {
+						errCh <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		require.NoError(t, err)
+	}
+
+	batch := db.NewBatch()
+	require.NoError(t, batch.Put([]byte("batch"), []byte("batchvalue")))
+	require.NoError(t, batch.Commit())
+	require.Equal(t, ErrKeyNotFound, db.Delete([]byte("missing")))
+
+	// Concurrent writes share fsyncs
+	writes := workers * n + workers * n / 2 + 1
+	syncs := atomic.LoadInt64(&counter.syncs)
+	require.Greater(t, syncs, int64(0))
+	require.Less(t, syncs, int64(writes))
+	require.NoError(t, db.Close())
+
+	// Writes after close fail instead of hanging
+	require.Equal(t, ErrDatabaseClosed, db.Put([]byte("closed"), []byte("value")))
+
+	db = openDB()
+	require.Equal(t, workers * n / 2 + 1, db.GetSize())
+	for w := 0; w < workers; w++ {
+		for i := 0; i < n; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("test%d-%d", w, i)))
+			if i % 2 == 0 {
+				require.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("testvalue%d-%d", w, i)), value)
+		}
+	}
+	require.NoError(t, db.Close())
+}
+
+func TestDB_BackgroundSync(t *testing.T) {
+	dir := "./test-background-sync"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func(ops ...Option) *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, append([]Option{WithDir(dir), WithSyncEnable(false), WithMergeInteval(time.Second * 6000)}, ops...)...)
+		require.NoError(t, err)
+		return db
+	}
+	unsynced := func(db *DB) int64 {
+		return atomic.LoadInt64(&db.syncer.unsynced)
+	}
+
+	// Synced every interval
+	db := openDB(WithSyncInterval(time.Millisecond * 10))
+	require.NoError(t, db.Put([]byte("test"), []byte("testvalue")))
+	require.Eventually(t, func() bool { return unsynced(db) == 0 }, time.Second, time.Millisecond * 5)
+	require.NoError(t, db.Close())
+
+	// Synced after enough bytes, the rest is synced on close
+	db = openDB(WithSyncBytes(1024))
+	for i := 0; unsynced(db) < 512; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+	time.Sleep(time.Millisecond * 20)
+	require.Greater(t, unsynced(db), int64(0))
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+	require.Eventually(t, func() bool { return unsynced(db) < 1024 }, time.Second, time.Millisecond * 5)
+
+	syncer := db.syncer
+	require.NoError(t, db.Close())
+	require.Equal(t, int64(0), atomic.LoadInt64(&syncer.unsynced))
+}
+
+func TestDB_WriteBuffer(t *testing.T) {
+	dir := "./test-write-buffer"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	segmentsSize := func() int64 {
+		var size int64
+		files, err := filepath.Glob(filepath.Join(dir, "*.SEG"))
+		require.NoError(t, err)
+		for _, file := range files {
+			info, err := os.Stat(file)
+			require.NoError(t, err)
+			size += info.Size()
+		}
+		return size
+	}
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1024 * 1), WithWriteBufferSize(1 << 20), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+
+	// Buffered records are read before they are written to the segment
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+	require.Equal(t, int64(0), segmentsSize())
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+	}
+
+	// Sync writes the buffer
+	require.NoError(t, db.wal.Sync())
+	size := segmentsSize()
+	require.Greater(t, size, int64(0))
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("test%d", i))))
+	}
+	require.Equal(t, size, segmentsSize())
+	require.NoError(t, db.Merge())
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+		if i < 50 {
+			require.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+	}
+
+	// Close writes the buffer
+	require.NoError(t, db.Put([]byte("test100"), []byte("testvalue100")))
+	require.NoError(t, db.Close())
+
+	opt = *DefaultOptions
+	db, err = Open(&opt, WithDir(dir), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	for i := 50; i <= 100; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+	}
+	require.NoError(t, db.Close())
+}
+
+func TestDB_MmapReads(t *testing.T) {
+	dir := "./test-mmap-reads"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	openDB := func() *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMmapReads(true), WithMergeInteval(time.Second * 6000))
+		require.NoError(t, err)
+		return db
+	}
+	checkValues := func(db *DB) {
+		for i := 0; i < 200; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("test%d", i)))
+			if i % 2 == 0 {
+				require.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("testvalue%d", i)), value)
+		}
+	}
+
+	// Older segments are mapped when they are rotated
+	db := openDB()
+	for i := 0; i < 200; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), []byte(fmt.Sprintf("testvalue%d", i))))
+	}
+	for i := 0; i < 200; i += 2 {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("test%d", i))))
+	}
+	checkValues(db)
+
+	// Merged segments are mapped when they are loaded
+	require.NoError(t, db.Merge())
+	checkValues(db)
+	require.NoError(t, db.Close())
+
+	// Older segments are mapped on open
+	db = openDB()
+	checkValues(db)
+	require.NoError(t, db.Close())
+}
+
+func benchmarkDBGet(b *testing.B, mmapReads bool) {
+	dir := "./bench-get"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1024 * 4), WithMmapReads(mmapReads), WithMergeInteval(time.Second * 6000))
+	require.NoError(b, err)
+	defer db.Close()
+
+	value := make([]byte, 128)
+	for i := 0; i < 100000; i++ {
+		require.NoError(b, db.Put([]byte(fmt.Sprintf("test%d", i)), value))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("test%d", i % 100000))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDB_GetPread(b *testing.B) {
+	benchmarkDBGet(b, false)
+}
+
+func BenchmarkDB_GetMmap(b *testing.B) {
+	benchmarkDBGet(b, true)
+}
+
+func TestDB_View(t *testing.T) {
+	dir := "./test-view"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMmapReads(true), WithCodec(CODEC_SNAPPY), WithCompressThreshold(64), WithWriteBufferSize(256), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+
+	// Values from older segments, the write buffer and compressed ones are viewed like Get
+	for i := 0; i < 100; i++ {
+		value := []byte(fmt.Sprintf("testvalue%d", i))
+		if i % 10 == 0 {
+			value = bytes.Repeat(value, 20)
+		}
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), value))
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("test%d", i))
+		expected, err := db.Get(key)
+		require.NoError(t, err)
+		require.NoError(t, db.View(key, func(value []byte) error {
+			require.Equal(t, expected, value)
+			return nil
+		}))
+	}
+
+	require.Equal(t, ErrKeyNotFound, db.View([]byte("test100"), func(value []byte) error {
+		return nil
+	}))
+	errView := errors.New("view error")
+	require.Equal(t, errView, db.View([]byte("test1"), func(value []byte) error {
+		return errView
+	}))
+
+	// Views of mapped values do not allocate more than the record
+	require.NoError(t, db.Rotate())
+	key := []byte("test1")
+	allocs := testing.AllocsPerRun(100, func() {
+		db.View(key, func(value []byte) error {
+			return nil
+		})
+	})
+	require.Less(t, allocs, testing.AllocsPerRun(100, func() {
+		db.Get(key)
+	}))
+	require.NoError(t, db.Close())
+}
+
+func TestDB_SizeLimits(t *testing.T) {
+	dir := "./test-size-limits"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMaxKeySize(16), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+
+	require.Equal(t, ErrKeyEmpty, db.Put(nil, []byte("testvalue")))
+	require.Equal(t, ErrKeyEmpty, db.Delete([]byte("")))
+	require.Equal(t, ErrKeyTooLarge, db.Put(bytes.Repeat([]byte("k"), 17), []byte("testvalue")))
+	batch := db.NewBatch()
+	require.Equal(t, ErrKeyEmpty, batch.Put(nil, []byte("testvalue")))
+	require.Equal(t, ErrKeyEmpty, batch.Delete(nil))
+
+	// Values are limited to what fits in a segment, oversized ones do not create segments
+	key := []byte("test")
+	maxValue := bytes.Repeat([]byte("v"), int(wal.MaxDataSize(1024)) - int(RECORD_HEAD_SIZE) - len(key))
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, ErrValueTooLarge, db.Put(key, append(maxValue, 'v')))
+	}
+	after, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	require.Equal(t, fids, after)
+
+	require.NoError(t, db.Put(key, maxValue))
+	value, err := db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, maxValue, value)
+	require.NoError(t, db.Close())
+
+	// Values are limited by the max value size
+	opt = *DefaultOptions
+	db, err = Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMaxValueSize(100), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	require.Equal(t, ErrValueTooLarge, db.Put(key, bytes.Repeat([]byte("v"), 101)))
+	require.NoError(t, db.Put(key, bytes.Repeat([]byte("v"), 100)))
+	require.NoError(t, db.Close())
+
+	// Keys written before the max key size was set can still be deleted
+	opt = *DefaultOptions
+	db, err = Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMaxKeySize(0), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	longKeys := make([][]byte, 4)
+	for i := range longKeys {
+		longKeys[i] = bytes.Repeat([]byte{byte('a' + i)}, 100)
+		require.NoError(t, db.Put(longKeys[i], []byte("testvalue")))
+	}
+	require.NoError(t, db.Close())
+
+	opt = *DefaultOptions
+	db, err = Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMaxKeySize(16), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	require.NoError(t, db.Delete(longKeys[0]))
+	batch = db.NewBatch()
+	require.NoError(t, batch.Delete(longKeys[1]))
+	require.NoError(t, batch.Commit())
+	deleted, err := db.DeleteIfEquals(longKeys[2], []byte("testvalue"))
+	require.NoError(t, err)
+	require.True(t, deleted)
+	txn, err := db.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, txn.Delete(longKeys[3]))
+	require.NoError(t, txn.Commit())
+	for _, longKey := range longKeys {
+		_, err = db.Get(longKey)
+		require.Equal(t, ErrKeyNotFound, err)
+	}
+	require.NoError(t, db.Close())
+
+	// Records written with larger segments are still merged, each in a segment of its own
+	os.RemoveAll(dir)
+	largeValue := bytes.Repeat([]byte("v"), 3000)
+	opt = *DefaultOptions
+	db, err = Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 8), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("large%d", i)), largeValue))
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("small%d", i)), []byte("testvalue")))
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("small%d", i)), []byte("testvalue")))
+	}
+	require.NoError(t, db.Close())
+
+	check := func(db *DB) {
+		for i := 0; i < 3; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("large%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, largeValue, value)
+			value, err = db.Get([]byte(fmt.Sprintf("small%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte("testvalue"), value)
+		}
+	}
+	for j := 0; j < 2; j++ {
+		opt = *DefaultOptions
+		db, err = Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 2), WithMergeInteval(time.Second * 6000))
+		require.NoError(t, err)
+		check(db)
+		require.NoError(t, db.Merge())
+		check(db)
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestDB_Blob(t *testing.T) {
+	dir := "./test-blob"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	filesSize := func(ext string) int64 {
+		var size int64
+		files, err := filepath.Glob(filepath.Join(dir, "*" + ext))
+		require.NoError(t, err)
+		for _, file := range files {
+			info, err := os.Stat(file)
+			require.NoError(t, err)
+			size += info.Size()
+		}
+		return size
+	}
+	openDB := func(ops ...Option) *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, append([]Option{WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 4), WithBlobThreshold(100), WithMergeInteval(0)}, ops...)...)
+		require.NoError(t, err)
+		return db
+	}
+	blobValue := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("blob%d-%d|", i, version)), 20)
+	}
+	checkValues := func(db *DB) {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("test%d", i))
+			value, err := db.Get(key)
+			if i % 4 == 0 {
+				require.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+
+			expected := []byte(fmt.Sprintf("testvalue%d", i))
+			if i % 2 == 1 {
+				expected = blobValue(i, 1)
+			}
+			require.NoError(t, err)
+			require.Equal(t, expected, value)
+			require.NoError(t, db.View(key, func(value []byte) error {
+				require.Equal(t, expected, value)
+				return nil
+			}))
+		}
+	}
+
+	// Large values go to the blob log, the main log holds pointers to them
+	db := openDB()
+	for i := 0; i < 100; i++ {
+		value := []byte(fmt.Sprintf("testvalue%d", i))
+		if i % 2 == 1 {
+			value = blobValue(i, 0)
+		}
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), value))
+	}
+	require.Less(t, filesSize(wal.SEGMENT_FILE_EXT), int64(50 * 200))
+	require.Greater(t, filesSize(wal.BLOB_FILE_EXT), int64(50 * 200))
+
+	// Overwritten and deleted blobs are garbage, batches write blobs too
+	batch := db.NewBatch()
+	for i := 1; i < 100; i += 2 {
+		require.NoError(t, batch.Put([]byte(fmt.Sprintf("test%d", i)), blobValue(i, 1)))
+	}
+	require.NoError(t, batch.Commit())
+	for i := 0; i < 100; i += 4 {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("test%d", i))))
+	}
+	checkValues(db)
+
+	// Merge compacts blob segments by their garbage, their values are not copied by the segment merge
+	blobSize := filesSize(wal.BLOB_FILE_EXT)
+	// blobs moved by compaction do not fail transactions which read them
+	txn, err := db.Begin(false)
+	require.NoError(t, err)
+	for i := 1; i < 100; i += 2 {
+		_, err = txn.Get([]byte(fmt.Sprintf("test%d", i)))
+		require.NoError(t, err)
+	}
+	stats, err := db.merge.merge(context.Background(), false)
+	require.NoError(t, err)
+	require.Greater(t, stats.BlobSegmentsRead, 0)
+	require.Greater(t, stats.RecordsRewritten, 0)
+	require.Less(t, filesSize(wal.BLOB_FILE_EXT), blobSize)
+	require.NoError(t, txn.Commit())
+	checkValues(db)
+
+	require.NoError(t, db.Merge())
+	require.Less(t, filesSize(wal.SEGMENT_FILE_EXT), int64(50 * 200))
+	checkValues(db)
+	require.NoError(t, db.Close())
+
+	// Segments with blob pointers are merged with hint files
+	db = openDB(WithBlobGarbageRatio(0), WithSegmentGarbageRatio(0.1))
+	for i := 3; i < 100; i += 4 {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%d", i)), blobValue(i, 1)))
+	}
+	require.NoError(t, db.Rotate())
+	stats, err = db.merge.merge(context.Background(), false)
+	require.NoError(t, err)
+	require.Greater(t, stats.SegmentsRead, 0)
+	require.Equal(t, 0, stats.BlobSegmentsRead)
+	require.Greater(t, filesSize(utils.HINT_FILE_EXT), int64(0))
+	require.NoError(t, db.Close())
+
+	// Blobs are found again on open, full merge leaves no garbage
+	db = openDB()
+	checkValues(db)
+	blobDead := func() int64 {
+		var dead int64
+		for _, stat := range db.blobStats {
+			dead += stat.dead
+		}
+		return dead
+	}
+	dead := blobDead()
+	require.NoError(t, db.Put([]byte("test3"), blobValue(3, 1)))
+	require.Greater(t, blobDead(), dead)
+	require.NoError(t, db.Merge())
+	checkValues(db)
+	for fid, stat := range db.blobStats {
+		require.Equal(t, int64(0), stat.dead, "blob segment %d", fid)
+	}
+	require.NoError(t, db.Close())
+
+	// Blobs are read without the blob threshold
+	opt := *DefaultOptions
+	db, err = Open(&opt, WithDir(dir), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	checkValues(db)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_Snapshot(t *testing.T) {
+	t.Run("btree", func(t *testing.T) {
+		testDBSnapshot(t, index.BTreeIndex)
+	})
+	t.Run("hashmap", func(t *testing.T) {
+		testDBSnapshot(t, index.HashMapIndex)
+	})
+	t.Run("art", func(t *testing.T) {
+		testDBSnapshot(t, index.ARTIndex)
+	})
+}
+
+func testDBSnapshot(t *testing.T, indexType index.IndexType) {
+	dir := "./test-snapshot"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithBlobThreshold(100), WithMergeInteval(0), WithIndexType(indexType))
+	require.NoError(t, err)
+
+	value := func(i, version int) []byte {
+		if i % 5 == 0 {
+			return bytes.Repeat([]byte(fmt.Sprintf("blob%d-%d|", i, version)), 20)
+		}
+		return []byte(fmt.Sprintf("testvalue%d-%d", i, version))
+	}
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("test%03d", i)), value(i, 0)))
+	}
+
+	snap := db.Snapshot()
+	require.Equal(t, uint64(100), snap.Seq())
+
+	// Writes after the snapshot are not seen by it
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("test%03d", i))
+		if i % 2 == 0 {
+			require.NoError(t, db.Delete(key))
+		} else {
+			require.NoError(t, db.Put(key, value(i, 1)))
+		}
+	}
+	require.NoError(t, db.Put([]byte("test100"), value(100, 1)))
+
+	checkSnapshot := func() {
+		for i := 0; i < 100; i++ {
+			v, err := snap.Get([]byte(fmt.Sprintf("test%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, value(i, 0), v)
+		}
+		_, err := snap.Get([]byte("test100"))
+		require.Equal(t, ErrKeyNotFound, err)
+
+		it := snap.NewIterator(IteratorOptions{Prefix: []byte("test")})
+		defer it.Close()
+		i := 0
+		for ; it.Valid(); it.Next() {
+			require.Equal(t, []byte(fmt.Sprintf("test%03d", i)), it.Key())
+			v, err := it.Value()
+			require.NoError(t, err)
+			require.Equal(t, value(i, 0), v)
+			i++
+		}
+		require.Equal(t, 100, i)
+	}
+	checkSnapshot()
+
+	// Merge keeps the segments of the snapshot
+	require.NoError(t, db.Merge())
+	checkSnapshot()
+	for i := 0; i < 100; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("test%03d", i)))
+		if i % 2 == 0 {
+			require.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, value(i, 1), v)
+	}
+	require.Greater(t, db.Snapshot().Seq(), snap.Seq())
+
+	// Once released, its segments are merged
+	for s := range db.snapshots {
+		s.Release()
+	}
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	stats, err := db.MergeWithContext(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, len(fids), stats.SegmentsRead)
+	require.Greater(t, stats.BlobSegmentsRead, 0)
+	for i := 1; i < 100; i += 2 {
+		v, err := db.Get([]byte(fmt.Sprintf("test%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, value(i, 1), v)
+	}
+	require.NoError(t, db.Close())
+}
+
+func TestDB_Txn(t *testing.T) {
+	dir := "./test-txn"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("test1"), []byte("testvalue1")))
+
+	// Writes are seen by the transaction and by others once committed
+	txn, err := db.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put([]byte("test2"), []byte("testvalue2")))
+	require.NoError(t, txn.Delete([]byte("test1")))
+	value, err := txn.Get([]byte("test2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("testvalue2"), value)
+	_, err = txn.Get([]byte("test1"))
+	require.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("test2"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, txn.Commit())
+	require.Equal(t, ErrTxnDone, txn.Commit())
+	_, err = db.Get([]byte("test1"))
+	require.Equal(t, ErrKeyNotFound, err)
+	value, err = db.Get([]byte("test2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("testvalue2"), value)
+
+	// A read key written by others fails the commit, also if it did not exist
+	for _, key := range [][]byte{[]byte("test2"), []byte("test3")} {
+		txn, err = db.Begin(true)
+		require.NoError(t, err)
+		txn.Get(key)
+		require.NoError(t, db.Put(key, []byte("other")))
+		require.NoError(t, txn.Put(key, []byte("mine")))
+		require.Equal(t, ErrTxnConflict, txn.Commit())
+		value, err = db.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("other"), value)
+	}
+
+	// Keys written but not read do not conflict
+	txn, err = db.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("test4"), []byte("other")))
+	require.NoError(t, txn.Put([]byte("test4"), []byte("mine")))
+	require.NoError(t, txn.Commit())
+
+	// Rolled back writes are discarded, read-only transactions do not write
+	txn, err = db.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put([]byte("test5"), []byte("testvalue5")))
+	require.NoError(t, txn.Rollback())
+	require.Equal(t, ErrTxnDone, txn.Put([]byte("test5"), []byte("testvalue5")))
+	_, err = db.Get([]byte("test5"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	txn, err = db.Begin(false)
+	require.NoError(t, err)
+	require.Equal(t, ErrTxnReadOnly, txn.Put([]byte("test5"), []byte("testvalue5")))
+	require.NoError(t, txn.Commit())
+
+	// Reads are checked without writes too
+	for _, readWrite := range []bool{false, true} {
+		txn, err = db.Begin(readWrite)
+		require.NoError(t, err)
+		_, err = txn.Get([]byte("test2"))
+		require.NoError(t, err)
+		require.NoError(t, db.Put([]byte("test2"), []byte("other2")))
+		require.Equal(t, ErrTxnConflict, txn.Commit())
+	}
+
+	// Records moved by merge are not written, whether written since open or loaded
+	for i := 0; i < 2; i++ {
+		txn, err = db.Begin(true)
+		require.NoError(t, err)
+		_, err = txn.Get([]byte("test2"))
+		require.NoError(t, err)
+		before := db.data.Get([]byte("test2"))
+		require.NoError(t, db.Rotate())
+		require.NoError(t, db.Merge())
+		require.False(t, samePos(before, db.data.Get([]byte("test2"))))
+		require.NoError(t, txn.Put([]byte("test6"), []byte("testvalue6")))
+		require.NoError(t, txn.Commit())
+
+		require.NoError(t, db.Close())
+		opt = *DefaultOptions
+		db, err = Open(&opt, WithDir(dir), WithSyncEnable(false), WithMaxActiveFileSize(1024 * 1), WithMergeInteval(time.Second * 6000))
+		require.NoError(t, err)
+	}
+
+	// Concurrent increments retried on conflict lose no update
+	require.NoError(t, db.Put([]byte("counter"), []byte("0")))
+	increment := func() error {
+		txn, err := db.Begin(true)
+		if err != nil {
+			return err
+		}
+		value, err := txn.Get([]byte("counter"))
+		if err != nil {
+			return err
+		}
+		var n int
+		fmt.Sscan(string(value), &n)
+		if err := txn.Put([]byte("counter"), []byte(fmt.Sprint(n + 1))); err != nil {
+			return err
+		}
+		return txn.Commit()
+	}
+	var wg sync.WaitGroup
+	errCh := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; {
+				if err := increment(); err == ErrTxnConflict {
+					continue
+				} else if err != nil {
+					errCh <- err
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	// Committed transactions survive reopen
+	opt = *DefaultOptions
+	db, err = Open(&opt, WithDir(dir), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+	value, err = db.Get([]byte("counter"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("160"), value)
+	value, err = db.Get([]byte("test4"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("mine"), value)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_ConditionalWrites(t *testing.T) {
+	dir := "./test-conditional-writes"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	opt := *DefaultOptions
+	db, err := Open(&opt, WithDir(dir), WithSyncEnable(false), WithMergeInteval(time.Second * 6000))
+	require.NoError(t, err)
+
+	key := []byte("lock")
+	ok, err := db.PutIfAbsent(key, []byte("owner1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = db.PutIfAbsent(key, []byte("owner2"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = db.CompareAndSwap(key, []byte("owner2"), []byte("owner3"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = db.CompareAndSwap(key, []byte("owner1"), []byte("owner3"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	value, err := db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("owner3"), value)
+
+	ok, err = db.DeleteIfEquals(key, []byte("owner1"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = db.DeleteIfEquals(key, []byte("owner3"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, err = db.Get(key)
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// Missing and expired keys are absent
+	ok, err = db.CompareAndSwap(key, nil, []byte("owner1"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, db.PutWithTTL(key, []byte("owner1"), time.Millisecond))
+	time.Sleep(time.Millisecond * 5)
+	ok, err = db.PutIfAbsent(key, []byte("owner2"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, db.Delete(key))
+
+	// Only one of concurrent owners takes the lock at a time
+	var wg sync.WaitGroup
+	var held, taken int32
+	errCh := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			owner := []byte(fmt.Sprintf("owner%d", g))
+			for i := 0; i < 20; {
+				ok, err := db.PutIfAbsent(key, owner)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if !ok {
+					continue
+				}
+				if n := atomic.AddInt32(&held, 1); n != 1 {
+					errCh <- fmt.Errorf("lock held by %d owners", n)
+					return
+				}
+				atomic.AddInt32(&taken, 1)
+				atomic.AddInt32(&held, -1)
+
+				ok, err = db.DeleteIfEquals(key, owner)
+				if err == nil && !ok {
+					err = fmt.Errorf("%s lost the lock", owner)
+				}
+				if err != nil {
+					errCh <- err
+					return
+				}
+				i++
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(160), taken)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_OpenV0(t *testing.T) {
+	dir := "./test-open-v0"
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	// the fixture was written by the first version, whose record head had no batch id and expiry
+	fixture := "testdata/v0"
+	fids, err := utils.GetDataFiles(fixture, wal.SEGMENT_FILE_EXT)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(fids))
+	require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+	for _, fid := range fids {
+		data, err := os.ReadFile(utils.GetSegmentFilePath(fixture, fid, wal.SEGMENT_FILE_EXT))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(utils.GetSegmentFilePath(dir, fid, wal.SEGMENT_FILE_EXT), data, 0666))
+	}
+
+	open := func() *DB {
+		opt := *DefaultOptions
+		db, err := Open(&opt, WithDir(dir), WithMaxActiveFileSize(1024), WithMergeInteval(0))
+		require.NoError(t, err)
+		return db
+	}
+	// key-00..09 were overwritten and key-10..19 deleted
+	check := func(db *DB) {
+		for i := 0; i < 40; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("key-%02d", i)))
+			switch {
+			case i < 10:
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("new-%02d", i)), value)
+			case i < 20:
+				require.Equal(t, ErrKeyNotFound, err)
+			default:
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("value-%02d", i)), value)
+			}
+		}
+		value, err := db.Get([]byte("key-40"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value-40"), value)
+	}
+
+	// new records are written in the current format next to the old ones
+	db := open()
+	require.Equal(t, 30, db.GetSize())
+	require.NoError(t, db.PutWithTTL([]byte("key-40"), []byte("value-40"), time.Hour))
+	check(db)
+	require.NoError(t, db.Close())
+
+	db = open()
+	check(db)
+
+	// merge rewrites the old records in the current format
+	require.NoError(t, db.Merge())
+	reader, err := db.wal.NewWalReader(0)
+	require.NoError(t, err)
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		r, err := DecodeRecord(data)
+		require.NoError(t, err)
+		require.False(t, r.isV0())
+	}
+	require.NoError(t, reader.Close())
+	check(db)
+	require.NoError(t, db.Close())
+
+	db = open()
+	check(db)
+	require.NoError(t, db.Close())
+}
@@ -1,8 +1,60 @@
 package minibitcask
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrKeyNotFound is returned when a key is not found in the database.
 	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrBatchCommitted is returned when a batch is used after it has been committed.
+	ErrBatchCommitted = errors.New("batch already committed")
+
+	// ErrDatabaseLocked is returned when the database dir is opened by another process.
+	ErrDatabaseLocked = errors.New("database is locked by another process")
+
+	// ErrReadOnly is returned when writing to a database opened read-only.
+	ErrReadOnly = errors.New("database is read-only")
+
+	// ErrMergeUnfinished is returned when opening read-only a database whose last merge
+	// was interrupted before its files were published.
+	ErrMergeUnfinished = errors.New("merge is unfinished, open database read-write to complete it")
+
+	// ErrUnknownCodec is returned for a compression codec this version does not know.
+	ErrUnknownCodec = errors.New("unknown compression codec")
+
+	// ErrDatabaseClosed is returned when writing to a closed database.
+	ErrDatabaseClosed = errors.New("database is closed")
+
+	// ErrKeyEmpty is returned when writing an empty key.
+	ErrKeyEmpty = errors.New("key is empty")
+
+	// ErrKeyTooLarge is returned when a key is larger than the max key size.
+	ErrKeyTooLarge = errors.New("key is too large")
+
+	// ErrValueTooLarge is returned when a value is larger than the max value size,
+	// or its record does not fit in a segment.
+	ErrValueTooLarge = errors.New("value is too large")
+
+	// ErrTxnConflict is returned when committing a transaction whose read keys
+	// were changed by others since it read them.
+	ErrTxnConflict = errors.New("transaction conflict")
+
+	// ErrTxnDone is returned when a transaction is used after commit or rollback.
+	ErrTxnDone = errors.New("transaction already committed or rolled back")
+
+	// ErrTxnReadOnly is returned when writing in a read-only transaction.
+	ErrTxnReadOnly = errors.New("transaction is read-only")
 )
+
+// ErrCorruptRecord is returned when a record does not match its crc.
+type ErrCorruptRecord struct {
+	Fid    uint32
+	Offset int64
+}
+
+func (e *ErrCorruptRecord) Error() string {
+	return fmt.Sprintf("corrupt record in segment %d at offset %d", e.Fid, e.Offset)
+}
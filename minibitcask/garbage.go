@@ -0,0 +1,209 @@
+package minibitcask
+
+import (
+	"minibitcask/utils"
+	"minibitcask/wal"
+	"os"
+)
+
+// segmentStat counts the bytes of a segment and how many of them belong to
+// records which are overwritten or deleted.
+type segmentStat struct {
+	size int64
+	dead int64
+	// deletes are garbage once no segment is left which may hold records they shadow
+	tombstones int64
+	shadows    uint32 // highest fid which may hold a record shadowed by the deletes
+	shadowing  bool   // false if the deletes shadow no record
+}
+
+func (s *segmentStat) ratio() float64 {
+	if s.size <= 0 {
+		return 0
+	}
+	return float64(s.dead) / float64(s.size)
+}
+
+// shadowsFrom reports whether the deletes of the segment may shadow records in
+// segments from firstFid on.
+func (s *segmentStat) shadowsFrom(firstFid uint32) bool {
+	return s.shadowing && s.shadows >= firstFid
+}
+
+// garbageRatio is the ratio of dead bytes with deletes counted as dead if they
+// shadow no segment from firstFid on, or if they are dropped anyway.
+func (s *segmentStat) garbageRatio(firstFid uint32, dropTombstones bool) float64 {
+	if s.size <= 0 {
+		return 0
+	}
+	dead := s.dead
+	if dropTombstones || !s.shadowsFrom(firstFid) {
+		dead += s.tombstones
+	}
+	return float64(dead) / float64(s.size)
+}
+
+// shadow records that the deletes of stat may shadow records up to segment fid.
+func (s *segmentStat) shadow(fid uint32) {
+	if !s.shadowing || fid > s.shadows {
+		s.shadows, s.shadowing = fid, true
+	}
+}
+
+// loadSegmentStat resets the stat of segment fid to its file size.
+func (db *DB) loadSegmentStat(fid uint32) error {
+	info, err := os.Stat(utils.GetSegmentFilePath(db.opt.dir, fid, wal.SEGMENT_FILE_EXT))
+	if err != nil {
+		return err
+	}
+
+	db.stats[fid] = &segmentStat{size: info.Size()}
+	return nil
+}
+
+// addWritten counts the record written at walPos.
+func (db *DB) addWritten(walPos wal.WalPos) {
+	stat, ok := db.stats[walPos.GetFileFid()]
+	if !ok {
+		stat = &segmentStat{}
+		db.stats[walPos.GetFileFid()] = stat
+	}
+	stat.size += walPos.GetValueSize()
+}
+
+// addDead counts the record at walPos as garbage. Merge is asked to run once the
+// segment reaches the segment garbage ratio.
+func (db *DB) addDead(walPos wal.WalPos) {
+	stat, ok := db.stats[walPos.GetFileFid()]
+	if !ok {
+		return
+	}
+
+	threshold := db.opt.segmentGarbageRatio
+	before := stat.ratio()
+	stat.dead += walPos.GetValueSize()
+	if db.merge != nil && threshold > 0 && before < threshold && stat.ratio() >= threshold {
+		db.merge.notify()
+	}
+}
+
+// addTombstone counts the delete at walPos, which removed the record at old or
+// nothing if old is nil.
+func (db *DB) addTombstone(walPos wal.WalPos, old wal.WalPos) {
+	stat, ok := db.stats[walPos.GetFileFid()]
+	if !ok {
+		return
+	}
+
+	stat.tombstones += walPos.GetValueSize()
+	if old != nil {
+		stat.shadow(old.GetFileFid())
+	}
+}
+
+// indexPut points key to walPos and counts the record it replaces as garbage.
+func (db *DB) indexPut(key []byte, walPos wal.WalPos) {
+	if old := db.data.Put(key, walPos); old != nil {
+		db.addDead(old)
+		db.releaseBlob(old)
+	}
+}
+
+// indexDelete removes key and counts its record as garbage. It returns the
+// position of the removed record, nil if key did not exist.
+func (db *DB) indexDelete(key []byte) wal.WalPos {
+	old, ok := db.data.Delete(key)
+	if !ok {
+		return nil
+	}
+
+	db.addDead(old)
+	db.releaseBlob(old)
+	return old
+}
+
+// pickMergeRuns returns the segments of fids worth merging, grouped into runs of
+// adjacent segments. A segment is picked when its garbage ratio reaches the segment
+// ratio, or the overall ratio once the overall garbage ratio is reached. Deletes
+// count as garbage in the run of the first segment, since merge drops them there.
+func (db *DB) pickMergeRuns(fids []uint32) [][]uint32 {
+	db.rwLock.RLock()
+	defer db.rwLock.RUnlock()
+
+	if len(fids) == 0 {
+		return nil
+	}
+	firstFid := fids[0]
+	total := &segmentStat{}
+	for _, stat := range db.stats {
+		total.size += stat.size
+		total.dead += stat.dead
+		if !stat.shadowsFrom(firstFid) {
+			total.dead += stat.tombstones
+		}
+	}
+
+	threshold := db.opt.segmentGarbageRatio
+	if ratio := db.opt.garbageRatio; ratio > 0 && total.ratio() >= ratio && (threshold <= 0 || ratio < threshold) {
+		threshold = ratio
+	}
+	if threshold <= 0 {
+		return nil
+	}
+
+	var runs [][]uint32
+	var run []uint32
+	leading := true
+	for _, fid := range fids {
+		if stat, ok := db.stats[fid]; ok {
+			if ratio := stat.garbageRatio(firstFid, leading); ratio > 0 && ratio >= threshold {
+				run = append(run, fid)
+				continue
+			}
+		}
+		leading = false
+		if len(run) > 0 {
+			runs = append(runs, run)
+			run = nil
+		}
+	}
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+
+	return runs
+}
+
+// firstFid returns the lowest fid of the segments, db lock must be held.
+func (db *DB) firstFid() (uint32, bool) {
+	var first uint32
+	ok := false
+	for fid := range db.stats {
+		if !ok || fid < first {
+			first, ok = fid, true
+		}
+	}
+	return first, ok
+}
+
+// removeEmptySegments removes the sealed segments which hold no record, such as
+// the active segment sealed by a merge before anything was written to it.
+func (db *DB) removeEmptySegments() error {
+	db.rwLock.Lock()
+	defer db.rwLock.Unlock()
+
+	fids, err := utils.GetDataFiles(db.opt.dir, wal.SEGMENT_FILE_EXT)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		if stat, ok := db.stats[fid]; (ok && stat.size > 0) || fid == db.wal.ActiveFid() {
+			continue
+		}
+		if err := db.wal.RemoveSegment(fid); err != nil {
+			return err
+		}
+		delete(db.stats, fid)
+	}
+	return nil
+}
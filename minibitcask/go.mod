@@ -2,13 +2,20 @@ module minibitcask
 
 go 1.18
 
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/google/btree v1.1.2
+	github.com/klauspost/compress v1.16.7
+	github.com/plar/go-adaptive-radix-tree v1.0.5
+	github.com/stretchr/testify v1.8.4
+	github.com/xujiajun/utils v0.0.0-20220904132955-5f7c5b914235
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/cobra v1.7.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
-	github.com/xujiajun/utils v0.0.0-20220904132955-5f7c5b914235 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,90 @@
+package index
+
+import (
+	"bytes"
+	"minibitcask/wal"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+)
+
+// ART is an ordered index backed by an adaptive radix tree.
+type ART struct {
+	tree art.Tree
+}
+
+func NewART() *ART {
+	return &ART{tree: art.New()}
+}
+
+func (a *ART) Put(key []byte, pos wal.WalPos) wal.WalPos {
+	old, updated := a.tree.Insert(append([]byte(nil), key...), pos)
+	if !updated {
+		return nil
+	}
+	return old.(wal.WalPos)
+}
+
+func (a *ART) Get(key []byte) wal.WalPos {
+	value, ok := a.tree.Search(key)
+	if !ok {
+		return nil
+	}
+	return value.(wal.WalPos)
+}
+
+func (a *ART) Delete(key []byte) (wal.WalPos, bool) {
+	value, ok := a.tree.Delete(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(wal.WalPos), true
+}
+
+func (a *ART) Size() int {
+	return a.tree.Size()
+}
+
+func (a *ART) Iterator(lower, upper []byte, reverse bool) *Iterator {
+	var items []*Item
+	// only the subtree of the common prefix of both bounds has to be walked
+	var prefix []byte
+	if lower != nil && upper != nil {
+		for i := 0; i < len(lower) && i < len(upper) && lower[i] == upper[i]; i++ {
+			prefix = lower[:i+1]
+		}
+	}
+
+	collect := func(node art.Node) bool {
+		if node.Kind() != art.Leaf {
+			return true
+		}
+
+		key := []byte(node.Key())
+		if lower != nil && bytes.Compare(key, lower) < 0 {
+			return true
+		}
+		if upper != nil && bytes.Compare(key, upper) >= 0 {
+			return false
+		}
+		items = append(items, &Item{key: key, pos: node.Value().(wal.WalPos)})
+		return true
+	}
+
+	if len(prefix) > 0 {
+		a.tree.ForEachPrefix(prefix, collect)
+	} else {
+		a.tree.ForEach(collect)
+	}
+
+	return newIterator(sliceSource(items), reverse)
+}
+
+// Clone copies every key, it takes time linear in the size of the tree.
+func (a *ART) Clone() Indexer {
+	tree := art.New()
+	a.tree.ForEach(func(node art.Node) bool {
+		tree.Insert(node.Key(), node.Value())
+		return true
+	})
+	return &ART{tree: tree}
+}
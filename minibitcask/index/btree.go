@@ -0,0 +1,114 @@
+package index
+
+import (
+	"bytes"
+	"minibitcask/wal"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+const (
+	BTREE_DEGREE = 32
+)
+
+type Item struct {
+	key []byte
+	pos wal.WalPos
+}
+
+func lessItem(a, b *Item) bool {
+	return bytes.Compare(a.key, b.key) < 0
+}
+
+// BTree is an ordered in-memory index from key to the wal position of its record.
+// It is not safe for concurrent use, callers must hold the db lock.
+type BTree struct {
+	tree    *btree.BTreeG[*Item]
+	cloneMu sync.Mutex
+}
+
+func NewBTree() *BTree {
+	return &BTree{tree: btree.NewG(BTREE_DEGREE, lessItem)}
+}
+
+// Put sets the position of key and returns the position it replaces, if any.
+// The key is copied, callers may reuse it.
+func (bt *BTree) Put(key []byte, pos wal.WalPos) wal.WalPos {
+	old, ok := bt.tree.ReplaceOrInsert(&Item{key: append([]byte(nil), key...), pos: pos})
+	if !ok {
+		return nil
+	}
+	return old.pos
+}
+
+func (bt *BTree) Get(key []byte) wal.WalPos {
+	item, ok := bt.tree.Get(&Item{key: key})
+	if !ok {
+		return nil
+	}
+	return item.pos
+}
+
+// Delete removes key and returns its position, if any.
+func (bt *BTree) Delete(key []byte) (wal.WalPos, bool) {
+	item, ok := bt.tree.Delete(&Item{key: key})
+	if !ok {
+		return nil, false
+	}
+	return item.pos, true
+}
+
+func (bt *BTree) Size() int {
+	return bt.tree.Len()
+}
+
+// Iterator returns an iterator over the keys in [lower, upper). A nil bound is unbounded.
+// It walks a lazy clone of the tree, so items are read in chunks as it moves
+// instead of being collected up front.
+func (bt *BTree) Iterator(lower, upper []byte, reverse bool) *Iterator {
+	tree := bt.clone()
+	return newIterator(func(key []byte, inclusive bool, desc bool) []*Item {
+		var items []*Item
+		collect := func(item *Item) bool {
+			if desc && lower != nil && bytes.Compare(item.key, lower) < 0 || !desc && upper != nil && bytes.Compare(item.key, upper) >= 0 {
+				return false
+			}
+			// descending may start at upper, which is exclusive
+			if (desc && upper != nil && bytes.Equal(item.key, upper)) || (!inclusive && bytes.Equal(item.key, key)) {
+				return true
+			}
+			items = append(items, item)
+			return len(items) < ITERATOR_CHUNK_SIZE
+		}
+
+		switch {
+		case desc && key != nil && (upper == nil || bytes.Compare(key, upper) < 0):
+			tree.DescendLessOrEqual(&Item{key: key}, collect)
+		case desc && upper != nil:
+			tree.DescendLessOrEqual(&Item{key: upper}, collect)
+		case desc:
+			tree.Descend(collect)
+		case key != nil && (lower == nil || bytes.Compare(key, lower) > 0):
+			tree.AscendGreaterOrEqual(&Item{key: key}, collect)
+		case lower != nil:
+			tree.AscendGreaterOrEqual(&Item{key: lower}, collect)
+		default:
+			tree.Ascend(collect)
+		}
+		return items
+	}, reverse)
+}
+
+// Clone copies the tree lazily, nodes are copied once either tree writes to them.
+func (bt *BTree) Clone() Indexer {
+	return &BTree{tree: bt.clone()}
+}
+
+// clone may be called by readers sharing the db lock, but it changes the tree,
+// so they take turns.
+func (bt *BTree) clone() *btree.BTreeG[*Item] {
+	bt.cloneMu.Lock()
+	defer bt.cloneMu.Unlock()
+	return bt.tree.Clone()
+}
@@ -0,0 +1,110 @@
+package index
+
+import (
+	"bytes"
+	"minibitcask/wal"
+	"sort"
+)
+
+// HASHMAP_SHARDS is the number of maps a HashMap is split into, Clone shares them
+// and a write copies only the shard it changes.
+const HASHMAP_SHARDS = 256
+
+// HashMap is an unordered index, its iterator has to collect and sort the keys.
+type HashMap struct {
+	shards [HASHMAP_SHARDS]map[string]wal.WalPos
+	owned  [HASHMAP_SHARDS]bool // false if the shard may be shared with a clone
+}
+
+func NewHashMap() *HashMap {
+	hm := &HashMap{}
+	for i := range hm.shards {
+		hm.shards[i] = make(map[string]wal.WalPos)
+		hm.owned[i] = true
+	}
+	return hm
+}
+
+// shard returns the index of the shard of key, fnv-1a.
+func shard(key []byte) int {
+	hash := uint32(2166136261)
+	for _, b := range key {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return int(hash % HASHMAP_SHARDS)
+}
+
+// writable returns shard i, copied first if it may be shared with a clone.
+func (hm *HashMap) writable(i int) map[string]wal.WalPos {
+	if !hm.owned[i] {
+		data := make(map[string]wal.WalPos, len(hm.shards[i]))
+		for key, pos := range hm.shards[i] {
+			data[key] = pos
+		}
+		hm.shards[i], hm.owned[i] = data, true
+	}
+	return hm.shards[i]
+}
+
+func (hm *HashMap) Put(key []byte, pos wal.WalPos) wal.WalPos {
+	data := hm.writable(shard(key))
+	strKey := string(key)
+	old := data[strKey]
+	data[strKey] = pos
+	return old
+}
+
+func (hm *HashMap) Get(key []byte) wal.WalPos {
+	return hm.shards[shard(key)][string(key)]
+}
+
+func (hm *HashMap) Delete(key []byte) (wal.WalPos, bool) {
+	i := shard(key)
+	strKey := string(key)
+	if _, ok := hm.shards[i][strKey]; !ok {
+		return nil, false
+	}
+	data := hm.writable(i)
+	old := data[strKey]
+	delete(data, strKey)
+	return old, true
+}
+
+func (hm *HashMap) Size() int {
+	size := 0
+	for _, data := range hm.shards {
+		size += len(data)
+	}
+	return size
+}
+
+func (hm *HashMap) Iterator(lower, upper []byte, reverse bool) *Iterator {
+	var items []*Item
+	for _, data := range hm.shards {
+		for key, pos := range data {
+			item := &Item{key: []byte(key), pos: pos}
+			if lower != nil && bytes.Compare(item.key, lower) < 0 {
+				continue
+			}
+			if upper != nil && bytes.Compare(item.key, upper) >= 0 {
+				continue
+			}
+			items = append(items, item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return lessItem(items[i], items[j])
+	})
+
+	return newIterator(sliceSource(items), reverse)
+}
+
+// Clone shares the shards with the copy, a shard is copied once either map writes
+// to it.
+func (hm *HashMap) Clone() Indexer {
+	clone := &HashMap{shards: hm.shards}
+	hm.owned = [HASHMAP_SHARDS]bool{}
+	return clone
+}
@@ -0,0 +1,46 @@
+package index
+
+import (
+	"minibitcask/wal"
+)
+
+type IndexType int8
+
+const (
+	// BTreeIndex keeps keys ordered, it is the default index.
+	BTreeIndex IndexType = iota
+	// HashMapIndex has the fastest point lookups but must sort keys to iterate.
+	HashMapIndex
+	// ARTIndex is an adaptive radix tree, compact for keys sharing long prefixes.
+	// Taking a snapshot copies it, in time linear in the number of keys.
+	ARTIndex
+)
+
+// Indexer maps keys to the wal position of their latest record.
+// Implementations are not safe for concurrent use, callers must hold the db lock.
+type Indexer interface {
+	// Put sets the position of key and returns the position it replaces, if any.
+	// The key is copied, callers may reuse it.
+	Put(key []byte, pos wal.WalPos) wal.WalPos
+	// Get returns the position of key, nil if it does not exist.
+	Get(key []byte) wal.WalPos
+	// Delete removes key and returns its position, if any.
+	Delete(key []byte) (wal.WalPos, bool)
+	// Size returns the number of keys.
+	Size() int
+	// Iterator returns an iterator over the keys in [lower, upper). A nil bound is unbounded.
+	Iterator(lower, upper []byte, reverse bool) *Iterator
+	// Clone returns a copy of the index which is not changed by later writes.
+	Clone() Indexer
+}
+
+func NewIndexer(typ IndexType) Indexer {
+	switch typ {
+	case HashMapIndex:
+		return NewHashMap()
+	case ARTIndex:
+		return NewART()
+	default:
+		return NewBTree()
+	}
+}
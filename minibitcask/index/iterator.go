@@ -0,0 +1,122 @@
+package index
+
+import (
+	"bytes"
+	"minibitcask/wal"
+	"sort"
+)
+
+// ITERATOR_CHUNK_SIZE is the number of items an iterator reads from its index at once.
+const ITERATOR_CHUNK_SIZE = 256
+
+// itemSource returns up to ITERATOR_CHUNK_SIZE items next to key, in ascending key
+// order or descending if desc. A nil key starts at the first, or last, item. The
+// item of key itself is only returned if inclusive.
+type itemSource func(key []byte, inclusive bool, desc bool) []*Item
+
+// Iterator walks the items of an index as they were when it was created, so it
+// is safe to use while the index keeps changing. Items are read in chunks.
+type Iterator struct {
+	source  itemSource
+	items   []*Item // chunk of the current item, in iteration order
+	idx     int
+	reverse bool
+}
+
+func newIterator(source itemSource, reverse bool) *Iterator {
+	it := &Iterator{source: source, reverse: reverse}
+	it.Rewind()
+	return it
+}
+
+// sliceSource serves the items of a slice sorted by key asc, for indexes which
+// have to collect their items up front.
+func sliceSource(items []*Item) itemSource {
+	return func(key []byte, inclusive bool, desc bool) []*Item {
+		var res []*Item
+		if desc {
+			i := len(items) - 1
+			if key != nil {
+				i = sort.Search(len(items), func(i int) bool {
+					c := bytes.Compare(items[i].key, key)
+					return c > 0 || (c == 0 && !inclusive)
+				}) - 1
+			}
+			for ; i >= 0 && len(res) < ITERATOR_CHUNK_SIZE; i-- {
+				res = append(res, items[i])
+			}
+			return res
+		}
+
+		i := 0
+		if key != nil {
+			i = sort.Search(len(items), func(i int) bool {
+				c := bytes.Compare(items[i].key, key)
+				return c > 0 || (c == 0 && inclusive)
+			})
+		}
+		for ; i < len(items) && len(res) < ITERATOR_CHUNK_SIZE; i++ {
+			res = append(res, items[i])
+		}
+		return res
+	}
+}
+
+func (it *Iterator) fetch(key []byte, inclusive bool, desc bool) []*Item {
+	if it.source == nil {
+		return nil
+	}
+	return it.source(key, inclusive, desc)
+}
+
+// Rewind moves to the first key, or the last one in reverse order.
+func (it *Iterator) Rewind() {
+	it.items, it.idx = it.fetch(nil, true, it.reverse), 0
+}
+
+// Seek moves to the first key >= key, or the last key <= key in reverse order.
+func (it *Iterator) Seek(key []byte) {
+	it.items, it.idx = it.fetch(key, true, it.reverse), 0
+}
+
+// Next moves forward in the iteration order.
+func (it *Iterator) Next() {
+	it.idx++
+	if it.idx == len(it.items) && it.idx > 0 {
+		if items := it.fetch(it.items[it.idx-1].key, false, it.reverse); len(items) > 0 {
+			it.items, it.idx = items, 0
+		}
+	}
+}
+
+// Prev moves backward in the iteration order.
+func (it *Iterator) Prev() {
+	it.idx--
+	if it.idx == -1 && len(it.items) > 0 {
+		if items := it.fetch(it.items[0].key, false, !it.reverse); len(items) > 0 {
+			// the chunk is read against the iteration order
+			for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+				items[i], items[j] = items[j], items[i]
+			}
+			it.items, it.idx = items, len(items)-1
+		}
+	}
+}
+
+func (it *Iterator) Valid() bool {
+	return it.idx >= 0 && it.idx < len(it.items)
+}
+
+func (it *Iterator) Key() []byte {
+	return it.items[it.idx].key
+}
+
+func (it *Iterator) Value() wal.WalPos {
+	return it.items[it.idx].pos
+}
+
+func (it *Iterator) Close() {
+	it.source = nil
+	it.items = nil
+	it.idx = 0
+}
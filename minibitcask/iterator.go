@@ -0,0 +1,129 @@
+package minibitcask
+
+import (
+	"bytes"
+	"minibitcask/index"
+	"time"
+)
+
+type IteratorOptions struct {
+	// Prefix limits iteration to keys with this prefix.
+	Prefix []byte
+	// Start is the inclusive lower bound of keys.
+	Start []byte
+	// End is the exclusive upper bound of keys.
+	End []byte
+	// Reverse iterates keys in descending order.
+	Reverse bool
+}
+
+// Iterator iterates over the keys which exist when it is created, in key order.
+// Expired keys are skipped. The B-tree index is read in chunks as the iterator
+// moves, the hash map and ART indexes collect all keys in range when it is created.
+type Iterator struct {
+	db        *DB
+	snapshot  *Snapshot // nil if values are read from db
+	indexIter *index.Iterator
+}
+
+func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
+	db.rwLock.RLock()
+	defer db.rwLock.RUnlock()
+
+	return newIterator(db, db.data, opts)
+}
+
+// newIterator returns an iterator over the keys of data.
+func newIterator(db *DB, data index.Indexer, opts IteratorOptions) *Iterator {
+	lower, upper := opts.Start, opts.End
+	if len(lower) == 0 {
+		lower = nil
+	}
+	if len(upper) == 0 {
+		upper = nil
+	}
+
+	// narrow bounds to prefix
+	if len(opts.Prefix) > 0 {
+		if lower == nil || bytes.Compare(opts.Prefix, lower) > 0 {
+			lower = opts.Prefix
+		}
+		if end := prefixEnd(opts.Prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+			upper = end
+		}
+	}
+
+	it := &Iterator{
+		db:        db,
+		indexIter: data.Iterator(lower, upper, opts.Reverse),
+	}
+	it.skipExpired(it.indexIter.Next)
+
+	return it
+}
+
+// prefixEnd returns the smallest key greater than all keys with prefix,
+// or nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// skipExpired moves the iterator with move until it is at a key which has not expired.
+func (it *Iterator) skipExpired(move func()) {
+	now := time.Now().UnixMilli()
+	for it.indexIter.Valid() && isExpired(it.indexIter.Value(), now) {
+		move()
+	}
+}
+
+// Rewind moves to the first key, or the last one in reverse order.
+func (it *Iterator) Rewind() {
+	it.indexIter.Rewind()
+	it.skipExpired(it.indexIter.Next)
+}
+
+// Seek moves to the first key >= key, or the last key <= key in reverse order.
+func (it *Iterator) Seek(key []byte) {
+	it.indexIter.Seek(key)
+	it.skipExpired(it.indexIter.Next)
+}
+
+// Next moves to the next key in iteration order.
+func (it *Iterator) Next() {
+	it.indexIter.Next()
+	it.skipExpired(it.indexIter.Next)
+}
+
+// Prev moves to the previous key in iteration order.
+func (it *Iterator) Prev() {
+	it.indexIter.Prev()
+	it.skipExpired(it.indexIter.Prev)
+}
+
+func (it *Iterator) Valid() bool {
+	return it.indexIter.Valid()
+}
+
+func (it *Iterator) Key() []byte {
+	return it.indexIter.Key()
+}
+
+// Value returns the current value of the key, ErrKeyNotFound if it has been
+// deleted since the iterator was created.
+func (it *Iterator) Value() ([]byte, error) {
+	if it.snapshot != nil {
+		return it.snapshot.Get(it.indexIter.Key())
+	}
+	return it.db.Get(it.indexIter.Key())
+}
+
+func (it *Iterator) Close() {
+	it.indexIter.Close()
+}
@@ -1,47 +1,100 @@
 package minibitcask
 
 import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"minibitcask/utils"
 	"minibitcask/wal"
 	"os"
+	"sync/atomic"
 	"time"
+
+	"github.com/xujiajun/utils/filesystem"
 )
 
+// MERGE_BATCH_SIZE is the number of records merge checks against the index at once.
+const MERGE_BATCH_SIZE = 128
+
 type Merge struct {
 	interval time.Duration
-	beginCh  chan struct{}
+	beginCh  chan context.Context
+	checkCh  chan struct{} // asks for a merge picked by garbage ratio
 	closeCh  chan struct{}
-	endCh    chan error
+	endCh    chan *mergeResult
 	db       *DB
+	running  int32
+	limiter  *utils.RateLimiter // limits bytes read and written by merge
+	// ctx of background merges, canceled on close
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// MergeStats reports what a merge has done.
+type MergeStats struct {
+	SegmentsRead     int           // segments read and replaced
+	BytesReclaimed   int64         // size of read segments minus size of compacted ones
+	RecordsRewritten int           // records written into compacted segments
+	BlobSegmentsRead int           // blob segments compacted
+	Duration         time.Duration
+}
+
+// mergeEntry is a record read by merge, waiting to be checked for liveness.
+type mergeEntry struct {
+	data   []byte
+	record *Record
+	walPos wal.WalPos
+}
+
+type mergeResult struct {
+	stats MergeStats
+	err   error
 }
 
 func NewMerge(db *DB) *Merge {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Merge{
 		interval: db.GetOpt().GetMergeInteval(),
 		db:       db,
 		closeCh: make(chan struct{}),
-		beginCh: make(chan struct{}),
-		endCh: make(chan error),
+		beginCh: make(chan context.Context),
+		checkCh: make(chan struct{}, 1),
+		endCh: make(chan *mergeResult),
+		ctx:      ctx,
+		cancel:   cancel,
+		limiter:  utils.NewRateLimiter(db.GetOpt().GetMergeRateLimit()),
 	}
 }
 
 func (m *Merge) Start() {
-	if 0 == m.interval {
-		return
+	// without interval only merges asked by Merge are run
+	var tickCh <-chan time.Time
+	var checkCh <-chan struct{}
+	var tick *time.Ticker
+	if m.interval > 0 {
+		tick = time.NewTicker(m.interval)
+		tickCh = tick.C
+		checkCh = m.checkCh
 	}
 
-	tick := time.NewTicker(m.interval)
 	go func() {
 		for {
 			select {
-			case <-tick.C:
-				m.merge()
-			case <-m.beginCh:
-				m.endCh <- m.merge()
-				tick.Reset(m.interval)
+			case <-tickCh:
+				m.merge(m.ctx, false)
+			case <-checkCh:
+				m.merge(m.ctx, false)
+			case ctx := <-m.beginCh:
+				stats, err := m.merge(ctx, true)
+				m.endCh <- &mergeResult{stats: stats, err: err}
+				if tick != nil {
+					tick.Reset(m.interval)
+				}
 			case <-m.closeCh:
-				tick.Stop()
+				if tick != nil {
+					tick.Stop()
+				}
 				return
 			}
 		}
@@ -52,71 +105,746 @@ func (m *Merge) Stop() {
 	m.closeCh <- struct{}{}
 }
 
-func (m *Merge) beginMerge() error {
-	m.beginCh <- struct{}{}
-	return <-m.endCh
+// notify asks the background merge to check the garbage ratio of segments before
+// its next tick. It never blocks, a check already asked for covers this one.
+func (m *Merge) notify() {
+	select {
+	case m.checkCh <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Merge) beginMerge(ctx context.Context) (MergeStats, error) {
+	// wait for a background merge to finish
+	select {
+	case m.beginCh <- ctx:
+	case <-ctx.Done():
+		return MergeStats{}, ctx.Err()
+	}
+
+	res := <-m.endCh
+	return res.stats, res.err
+}
+
+// IsMerging reports whether a merge is running.
+func (m *Merge) IsMerging() bool {
+	return atomic.LoadInt32(&m.running) == 1
 }
 
 func (m *Merge) Close() {
+	// abort the background merge
+	m.cancel()
 	m.Stop()
 	close(m.closeCh)
 	close(m.beginCh)
 	close(m.endCh)
 }
 
-func (m *Merge) merge() error {
+// merge compacts the segments picked by their garbage ratio, or all sealed
+// segments if full is set. It stops at the next record once ctx is done.
+func (m *Merge) merge(ctx context.Context, full bool) (stats MergeStats, err error) {
+	atomic.StoreInt32(&m.running, 1)
+	defer atomic.StoreInt32(&m.running, 0)
+
+	begin := time.Now()
+	defer func() {
+		stats.Duration = time.Since(begin)
+	}()
+
+	dir := m.db.GetOpt().GetDir()
+
 	// get need merge files
-	fids, err := utils.GetDataFiles(m.db.GetOpt().GetDir(), wal.SEGMENT_FILE_EXT)
+	fids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
 	if err != nil {
-		return err
+		return stats, err
 	}
 
 	// no need merge
-	if len(fids) <= 1 {
-		return err
+	var runs [][]uint32
+	if len(fids) > 1 {
+		runs = [][]uint32{fids}
+		if !full {
+			runs = m.db.pickMergeRuns(fids)
+		}
+		// segments read by snapshots are merged once they are released
+		runs = m.db.unpinnedRuns(runs)
+	}
+	if runs, err = m.extendRuns(fids, runs); err != nil {
+		return stats, err
 	}
 
-	// rotate file
-	if err := m.db.Rotate(); err != nil {
-		return err
+	if len(runs) > 0 {
+		// compacted segments get fids above the active segment, which is sealed, so
+		// records written while merging are in later segments than them
+		startFids, err := m.reserveFids(runs)
+		if err != nil {
+			return stats, err
+		}
+
+		for i, run := range runs {
+			if err := m.mergeRun(ctx, run, startFids[i], startFids[i + 1] - 1, fids[0], &stats); err != nil {
+				return stats, err
+			}
+		}
+
+		// the active segment sealed by the reservation may have been empty
+		if err := m.db.removeEmptySegments(); err != nil {
+			return stats, err
+		}
 	}
 
-	reader, err := m.db.wal.NewWalReader(fids[len(fids) - 1])
+	// blob segments are compacted on their own
+	if err := m.compactBlobs(ctx, full, &stats); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// reserveFids reserves the fids of the compacted segments of runs above the active
+// segment. Records may grow as they are rewritten in the current format or
+// encrypted, so a run gets twice the fids its size needs, and the last segment of
+// a run grows beyond the segment size if they are still not enough. It returns the
+// first fid of each run followed by the end of the reserved fids.
+func (m *Merge) reserveFids(runs [][]uint32) ([]uint32, error) {
+	db := m.db
+	counts := make([]uint32, len(runs))
+	var total uint32
+	for i, run := range runs {
+		size, err := segmentsSize(db.opt.dir, run)
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = uint32(2 * (size / db.opt.maxActiveFileSize + 1))
+		total += counts[i]
+	}
+
+	db.rwLock.Lock()
+	first, err := db.wal.ReserveFids(total)
+	db.rwLock.Unlock()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	startFids := make([]uint32, len(runs) + 1)
+	startFids[0] = first
+	for i, n := range counts {
+		startFids[i + 1] = startFids[i] + n
+	}
+	return startFids, nil
+}
+
+// extendRuns moves the start of each run back to the segment where the batch it
+// starts in the middle of begins. Merge rewrites batch records as single ones and
+// drops finish records, so a batch has to be merged as a whole. A run which would
+// have to take in a segment pinned by a snapshot is left for later.
+func (m *Merge) extendRuns(fids []uint32, runs [][]uint32) ([][]uint32, error) {
+	m.db.rwLock.RLock()
+	pinnedFid, _, pinned, _ := m.db.pinnedFids()
+	m.db.rwLock.RUnlock()
+
+	pos := make(map[uint32]int, len(fids))
+	for i, fid := range fids {
+		pos[fid] = i
 	}
 
-	// interate
+	var res [][]uint32
+	for _, run := range runs {
+		for pos[run[0]] > 0 {
+			first, err := m.edgeBatchId(run[0], false)
+			if err != nil {
+				return nil, err
+			}
+			prev := fids[pos[run[0]] - 1]
+			if first == 0 {
+				break
+			}
+			last, err := m.edgeBatchId(prev, true)
+			if err != nil {
+				return nil, err
+			}
+			if last != first {
+				break
+			}
+			if pinned && prev <= pinnedFid {
+				run = nil
+				break
+			}
+			run = append([]uint32{prev}, run...)
+		}
+		if len(run) == 0 {
+			continue
+		}
+
+		// join runs which meet
+		if n := len(res); n > 0 && res[n - 1][len(res[n - 1]) - 1] >= run[0] {
+			for _, fid := range run {
+				if fid > res[n - 1][len(res[n - 1]) - 1] {
+					res[n - 1] = append(res[n - 1], fid)
+				}
+			}
+			continue
+		}
+		res = append(res, run)
+	}
+	return res, nil
+}
+
+// edgeBatchId returns the batch id of the first record of segment fid, or of its
+// last record if last. A segment which ends with a finish record ends with no batch.
+func (m *Merge) edgeBatchId(fid uint32, last bool) (uint64, error) {
+	reader, err := m.db.wal.NewSegmentReader(fid)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	var batchId uint64
 	for {
 		data, walPos, err := reader.Next()
 		if err == io.EOF {
-			break
+			return batchId, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		record, err := m.db.decodeRecord(data, walPos)
+		if err != nil {
+			if m.db.skipCorrupted(err) {
+				continue
+			}
+			return 0, err
+		}
+		batchId = record.GetBatchId()
+		if !last {
+			return batchId, nil
 		}
+		if record.GetFlag() == TYPE_RECORD_BATCH_FINISHED {
+			batchId = 0
+		}
+	}
+}
+
+// mergeRun rewrites the live records of the adjacent segments in run into new
+// segments from startFid to endFid. Records of batches are rewritten as single
+// ones. Deletes of keys which do not exist are kept as well if segments older than
+// the run, from firstFid on, may hold the records they shadow.
+func (m *Merge) mergeRun(ctx context.Context, run []uint32, startFid uint32, endFid uint32, firstFid uint32, stats *MergeStats) (err error) {
+	dir := m.db.GetOpt().GetDir()
+	minFid, maxFid := run[0], run[len(run) - 1]
+
+	// tombstones only shadow records in older segments, which are all merged with the first one
+	keepTombstones := minFid != firstFid
+	shadowing := make(map[uint32]bool, len(run))
+	m.db.rwLock.RLock()
+	for _, fid := range run {
+		if stat, ok := m.db.stats[fid]; ok {
+			shadowing[fid] = stat.shadowsFrom(firstFid)
+		}
+	}
+	m.db.rwLock.RUnlock()
+
+	// compacted segments and their hint files are written into the merge dir first
+	mergeDir := utils.GetMergeDir(dir)
+	if err := os.RemoveAll(mergeDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(mergeDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// a merge failed or canceled before its finish marker leaves nothing behind
+	published := false
+	defer func() {
+		if err != nil && !published {
+			os.RemoveAll(mergeDir)
+		}
+	}()
+
+	runSize, err := segmentsSize(dir, run)
+	if err != nil {
+		return err
+	}
+	rewritten := stats.RecordsRewritten
+
+	mergeWal, err := wal.OpenFileWal(&wal.Options{
+		DirPath:         mergeDir,
+		SegmentSize:     m.db.GetOpt().GetMaxActiveFileSize(),
+		SegmentFileExt:  wal.SEGMENT_FILE_EXT,
+		StartFid:        startFid,
+		EndFid:          endFid,
+		KeyProvider:     m.db.GetOpt().GetKeyProvider(),
+		WriteBufferSize: m.db.GetOpt().GetWriteBufferSize(),
+	})
+	if err != nil {
+		return err
+	}
+	defer mergeWal.Close()
+
+	// hint files hold keys in plain, so encrypted dbs go without them
+	hintWriter := &HintWriter{dir: mergeDir, fid: startFid, disabled: m.db.GetOpt().GetKeyProvider() != nil}
+	var hintRecords []*HintRecord
+	// segments with kept tombstones have no hint file and are scanned on open
+	noHint := make(map[uint32]struct{})
+	tombstones := make(map[uint32]int64)
+	// positions of skipped corrupt records, keys still pointing to them are dropped
+	corrupted := make(map[wal.FilePos]struct{})
+
+	// live records are looked up in batches, so db lock is taken once per batch
+	var pending []*mergeEntry
+	flush := func() error {
+		for _, e := range m.db.filterLive(pending) {
+			if err := m.limiter.WaitN(ctx, len(e.data)); err != nil {
+				return err
+			}
+			mergePos, err := mergeWal.Write(e.data)
+			if err != nil {
+				return err
+			}
+			if e.record.GetFlag() != TYPE_RECORD_PUT {
+				noHint[mergePos.GetFileFid()] = struct{}{}
+				tombstones[mergePos.GetFileFid()] += mergePos.GetValueSize()
+				stats.RecordsRewritten++
+				continue
+			}
+
+			hr := NewHintRecord(e.record.key, mergePos, e.record.ts, e.record.GetExpireAt(), recordBlob(e.record))
+			if err = hintWriter.Write(hr); err != nil {
+				return err
+			}
+			hintRecords = append(hintRecords, hr)
+			stats.RecordsRewritten++
+		}
+
+		pending = pending[:0]
+		return nil
+	}
+
+	mergeSegment := func(fid uint32) error {
+		reader, err := m.db.wal.NewSegmentReader(fid)
 		if err != nil {
 			return err
 		}
+		defer reader.Close()
+
+		// interate
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			data, walPos, err := reader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = m.limiter.WaitN(ctx, int(walPos.GetValueSize())); err != nil {
+				return err
+			}
+
+			// judge data is valid or not
+			record, err := m.db.decodeRecord(data, walPos)
+			if err != nil {
+				if m.db.skipCorrupted(err) {
+					corrupted[wal.FilePos{Fid: walPos.GetFileFid(), Offset: walPos.GetOffset(), ValueSize: walPos.GetValueSize()}] = struct{}{}
+					continue
+				}
+				return err
+			}
+
+			// records of the first version are upgraded to the current format as they are rewritten
+			if record.isV0() {
+				data = record.EncodeRecord()
+			}
+
+			// deletes which shadow no older segment left are dropped
+			if record.GetFlag() == TYPE_RECORD_DELETE && (!keepTombstones || !shadowing[fid]) {
+				continue
+			}
+
+			// expired records are dropped, a delete is left in their place to shadow older records
+			if record.GetFlag() == TYPE_RECORD_PUT && record.IsExpired(time.Now().UnixMilli()) {
+				m.db.deleteExpired(record.key, walPos)
+				if !keepTombstones {
+					continue
+				}
+				record = NewRecord(record.key, nil, TYPE_RECORD_DELETE)
+				data = record.EncodeRecord()
+			}
+
+			// batches are merged as a whole and their records are rewritten as single ones
+			if record.GetFlag() == TYPE_RECORD_BATCH_FINISHED {
+				continue
+			}
+			if record.GetBatchId() != 0 {
+				record.batchId = 0
+				data = record.EncodeRecord()
+			}
+
+			pending = append(pending, &mergeEntry{data: data, record: record, walPos: walPos})
+			if len(pending) >= MERGE_BATCH_SIZE {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, fid := range run {
+		if err = mergeSegment(fid); err != nil {
+			return err
+		}
+	}
+	if err = flush(); err != nil {
+		return err
+	}
+
+	if err = hintWriter.Flush(); err != nil {
+		return err
+	}
+
+	if err = mergeWal.Sync(); err != nil {
+		return err
+	}
+
+	mergedFids, err := utils.GetDataFiles(mergeDir, wal.SEGMENT_FILE_EXT)
+	if err != nil {
+		return err
+	}
+	// a run without live records leaves no segment behind
+	if stats.RecordsRewritten == rewritten {
+		mergedFids = nil
+	}
 
-		// judge data is valid or not
-		record := DecodeRecord(data)
-		if record.GetFlag() == TYPE_RECORD_DELETE {
+	for _, fid := range mergedFids {
+		if _, ok := noHint[fid]; ok || hintWriter.disabled {
+			if err = os.Remove(utils.GetHintFilePath(mergeDir, fid)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
 			continue
 		}
 
-		if err = m.db.MergeRecord(data, record, walPos); err != nil {
+		// segments without records still need a hint file
+		if !filesystem.PathIsExist(utils.GetHintFilePath(mergeDir, fid)) {
+			if err = (&HintWriter{dir: mergeDir, fid: fid}).Flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	mergedSize, err := segmentsSize(mergeDir, mergedFids)
+	if err != nil {
+		return err
+	}
+
+	// last chance to cancel, from here on the merge is complete even if the process dies while publishing
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	m.db.rwLock.Lock()
+	defer m.db.rwLock.Unlock()
+
+	// a snapshot taken while the run was merged reads its segments, the run is dropped
+	if fid, _, pinned, _ := m.db.pinnedFids(); pinned && fid >= minFid {
+		return os.RemoveAll(mergeDir)
+	}
+
+	if err = writeMergeFin(mergeDir, minFid, maxFid, mergedFids); err != nil {
+		return err
+	}
+	published = true
+
+	if err = m.publish(mergeDir, run, mergedFids, hintRecords, tombstones, corrupted); err != nil {
+		return err
+	}
+
+	stats.SegmentsRead += len(run)
+	stats.BytesReclaimed += runSize - mergedSize
+	return nil
+}
+
+// segmentsSize returns the total file size of segments fids in dir.
+func segmentsSize(dir string, fids []uint32) (int64, error) {
+	var size int64
+	for _, fid := range fids {
+		info, err := os.Stat(utils.GetSegmentFilePath(dir, fid, wal.SEGMENT_FILE_EXT))
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// publish replaces the merged segments with the compacted ones from mergeDir and
+// points the index at the rewritten records. db lock must be held.
+func (m *Merge) publish(mergeDir string, fids []uint32, mergedFids []uint32, hintRecords []*HintRecord, tombstones map[uint32]int64, corrupted map[wal.FilePos]struct{}) error {
+	db := m.db
+	dir := db.GetOpt().GetDir()
+	minFid, maxFid := fids[0], fids[len(fids) - 1]
+
+	// hint files of merged segments are stale, compacted segments bring their own
+	if err := removeHintFiles(dir, fids); err != nil {
+		return err
+	}
+
+	// move compacted segments and hint files into db dir
+	for _, fid := range mergedFids {
+		if err := moveMergeFiles(dir, mergeDir, fid); err != nil {
+			return err
+		}
+		if err := db.wal.LoadSegment(fid); err != nil {
+			return err
+		}
+		if err := db.loadSegmentStat(fid); err != nil {
+			return err
+		}
+		// kept deletes shadow the segments older than the merged ones
+		if size := tombstones[fid]; size > 0 {
+			db.stats[fid].tombstones = size
+			db.stats[fid].shadow(minFid - 1)
+		}
+	}
+
+	// delete merged files
+	firstFid, _ := db.firstFid()
+	for _, fid := range fids {
+		if err := db.wal.RemoveSegment(fid); err != nil {
+			return err
+		}
+		delete(db.stats, fid)
+	}
+
+	// deletes of later segments may be garbage now that the first segment is gone
+	if minFid == firstFid {
+		m.notify()
+	}
+
+	// records of these keys are lost, drop them instead of pointing to deleted segments
+	if len(corrupted) > 0 {
+		it := db.data.Iterator(nil, nil, false)
+		for ; it.Valid(); it.Next() {
+			walPos := it.Value()
+			if _, ok := corrupted[wal.FilePos{Fid: walPos.GetFileFid(), Offset: walPos.GetOffset(), ValueSize: walPos.GetValueSize()}]; ok {
+				db.data.Delete(it.Key())
+				db.releaseBlob(walPos)
+			}
+		}
+		it.Close()
+	}
+
+	// update index, keys written after merge read them already point to newer segments
+	stale := false
+	for _, hr := range hintRecords {
+		indexWalPos := db.data.Get(hr.key)
+		if indexWalPos != nil && indexWalPos.GetFileFid() >= minFid && indexWalPos.GetFileFid() <= maxFid {
+			db.data.Put(hr.key, newIndexPos(hr.GetWalPos(), hr.GetExpireAt(), hr.GetBlob(), indexVersion(indexWalPos)))
+		} else {
+			db.addDead(hr.GetWalPos())
+			stale = true
+		}
+	}
+
+	// deletes written while merging may shadow records copied into the compacted segments
+	if stale && len(mergedFids) > 0 {
+		last := mergedFids[len(mergedFids) - 1]
+		for fid, stat := range db.stats {
+			if fid > last && stat.shadowsFrom(minFid) && stat.shadows <= maxFid {
+				stat.shadow(last)
+			}
+		}
+	}
+
+	return os.RemoveAll(mergeDir)
+}
+
+// removeHintFiles removes the hint files of segments fids in dir.
+func removeHintFiles(dir string, fids []uint32) error {
+	for _, fid := range fids {
+		if err := os.Remove(utils.GetHintFilePath(dir, fid)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveMergeFiles moves the compacted segment fid and its hint file from mergeDir
+// into dir. Files already moved are skipped, so it can be redone after a crash.
+func moveMergeFiles(dir string, mergeDir string, fid uint32) error {
+	err := os.Rename(utils.GetSegmentFilePath(mergeDir, fid, wal.SEGMENT_FILE_EXT), utils.GetSegmentFilePath(dir, fid, wal.SEGMENT_FILE_EXT))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Rename(utils.GetHintFilePath(mergeDir, fid), utils.GetHintFilePath(dir, fid))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// writeMergeFin writes the finish marker of the merge into mergeDir: the range of
+// merged fids and the fids of the compacted segments followed by their checksum.
+func writeMergeFin(mergeDir string, minFid uint32, maxFid uint32, mergedFids []uint32) error {
+	buf := make([]byte, 4 * (len(mergedFids) + 3))
+	binary.LittleEndian.PutUint32(buf, minFid)
+	binary.LittleEndian.PutUint32(buf[4:], maxFid)
+	for i, fid := range mergedFids {
+		binary.LittleEndian.PutUint32(buf[4 * (i + 2):], fid)
+	}
+	binary.LittleEndian.PutUint32(buf[len(buf) - 4:], crc32.ChecksumIEEE(buf[:len(buf) - 4]))
+
+	return writeFileSync(utils.GetMergeFinFilePath(mergeDir), buf)
+}
+
+// readMergeFin reads the finish marker written by writeMergeFin. It returns false if
+// the marker is missing or was not completely written.
+func readMergeFin(mergeDir string) (uint32, uint32, []uint32, bool, error) {
+	buf, err := os.ReadFile(utils.GetMergeFinFilePath(mergeDir))
+	if os.IsNotExist(err) {
+		return 0, 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, 0, nil, false, err
+	}
+
+	if len(buf) < 12 || len(buf) % 4 != 0 {
+		return 0, 0, nil, false, nil
+	}
+	if crc32.ChecksumIEEE(buf[:len(buf) - 4]) != binary.LittleEndian.Uint32(buf[len(buf) - 4:]) {
+		return 0, 0, nil, false, nil
+	}
+
+	minFid := binary.LittleEndian.Uint32(buf)
+	maxFid := binary.LittleEndian.Uint32(buf[4:])
+	var mergedFids []uint32
+	for i := 8; i < len(buf) - 4; i += 4 {
+		mergedFids = append(mergedFids, binary.LittleEndian.Uint32(buf[i:]))
+	}
+
+	return minFid, maxFid, mergedFids, true, nil
+}
+
+// recoverMerge is called on open before any segment is loaded. A merge that has
+// written its finish marker is published, otherwise the merge dir is discarded and
+// the merged segments are still in place.
+func recoverMerge(dir string, readOnly bool) error {
+	mergeDir := utils.GetMergeDir(dir)
+	if !filesystem.PathIsExist(mergeDir) {
+		return nil
+	}
+
+	minFid, maxFid, mergedFids, ok, err := readMergeFin(mergeDir)
+	if err != nil {
+		return err
+	}
+
+	if readOnly {
+		// segments in dir may be half replaced, only a writer can fix them
+		if ok {
+			return ErrMergeUnfinished
+		}
+		return nil
+	}
+
+	if !ok {
+		return os.RemoveAll(mergeDir)
+	}
+
+	allFids, err := utils.GetDataFiles(dir, wal.SEGMENT_FILE_EXT)
+	if err != nil {
+		return err
+	}
+	var fids []uint32
+	for _, fid := range allFids {
+		if fid >= minFid && fid <= maxFid {
+			fids = append(fids, fid)
+		}
+	}
+
+	if err := removeHintFiles(dir, fids); err != nil {
+		return err
+	}
+
+	for _, fid := range mergedFids {
+		if err := moveMergeFiles(dir, mergeDir, fid); err != nil {
 			return err
 		}
 	}
 
 	// delete merged files
 	for _, fid := range fids {
-		file := utils.GetSegmentFilePath(m.db.GetOpt().GetDir(), fid, wal.SEGMENT_FILE_EXT)
-		// delete file in filesystem
-		if err = os.Remove(file); err != nil {
+		if err := os.Remove(utils.GetSegmentFilePath(dir, fid, wal.SEGMENT_FILE_EXT)); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
 
-	return err
+	return os.RemoveAll(mergeDir)
 }
 
+// writeFileSync is like os.WriteFile but makes sure the data is on disk.
+func writeFileSync(path string, data []byte) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
 
+// HintWriter collects the hint records of the merge segment being written and
+// writes them into its hint file once merge moves on to the next segment.
+type HintWriter struct {
+	dir      string
+	fid      uint32
+	buf      []byte
+	disabled bool // no hint file is written
+}
+
+func (hw *HintWriter) Write(hr *HintRecord) error {
+	if hw.disabled {
+		return nil
+	}
+
+	if hr.hint.fid != hw.fid {
+		if err := hw.Flush(); err != nil {
+			return err
+		}
+		hw.fid = hr.hint.fid
+	}
+
+	hw.buf = append(hw.buf, hr.EncodeHintRecord()...)
+	return nil
+}
+
+// Flush writes the buffered hint records followed by the checksum of the whole file.
+func (hw *HintWriter) Flush() error {
+	if hw.disabled {
+		return nil
+	}
+
+	footer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(footer, crc32.ChecksumIEEE(hw.buf))
+
+	err := writeFileSync(utils.GetHintFilePath(hw.dir, hw.fid), append(hw.buf, footer...))
+	if err != nil {
+		return err
+	}
+
+	hw.buf = hw.buf[:0]
+	return nil
+}
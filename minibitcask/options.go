@@ -1,12 +1,34 @@
 package minibitcask
 
-import "time"
+import (
+	"minibitcask/index"
+	"minibitcask/wal"
+	"time"
+)
 
 type Options struct {
 	dir	string
 	syncEnable bool
 	maxActiveFileSize int64
 	mergeInteval time.Duration
+	indexType index.IndexType
+	skipCorrupted bool
+	readOnly bool
+	garbageRatio float64
+	segmentGarbageRatio float64
+	mergeRateLimit int64
+	codec Codec
+	compressThreshold int
+	keyProvider wal.KeyProvider
+	groupCommit bool
+	syncInterval time.Duration
+	syncBytes int64
+	writeBufferSize int
+	mmapReads bool
+	maxKeySize int
+	maxValueSize int
+	blobThreshold int
+	blobGarbageRatio float64
 }
 
 var (
@@ -14,7 +36,13 @@ var (
 		dir:				"/tmp/",
 		syncEnable:			false,
 		maxActiveFileSize:	1024*1024,
-		mergeInteval:		time.Hour,}
+		mergeInteval:		time.Hour,
+		garbageRatio:		0.5,
+		segmentGarbageRatio:	0.8,
+		compressThreshold:	256,
+		maxKeySize:			1024*64,
+		blobGarbageRatio:	0.5,
+		indexType:			index.BTreeIndex,}
 )
 
 type Option func(*Options)
@@ -31,6 +59,78 @@ func WithSyncEnable(syncEnable bool) Option {
 	}
 }
 
+// WithGroupCommit makes synced writes of concurrent callers share one fsync. Each
+// write is still durable when it returns. It has no effect without sync enabled.
+func WithGroupCommit(groupCommit bool) Option {
+	return func(options *Options) {
+		options.groupCommit = groupCommit
+	}
+}
+
+// WithSyncInterval syncs the wal in the background every syncInterval when sync
+// is not enabled, which bounds how much is lost on a crash.
+func WithSyncInterval(syncInterval time.Duration) Option {
+	return func(options *Options) {
+		options.syncInterval = syncInterval
+	}
+}
+
+// WithSyncBytes syncs the wal in the background once syncBytes are written since
+// the last sync when sync is not enabled.
+func WithSyncBytes(syncBytes int64) Option {
+	return func(options *Options) {
+		options.syncBytes = syncBytes
+	}
+}
+
+// WithWriteBufferSize buffers writes in memory and writes them to the active
+// segment once writeBufferSize bytes are buffered, on sync, rotation and close.
+// Buffered writes are lost if the process crashes.
+func WithWriteBufferSize(writeBufferSize int) Option {
+	return func(options *Options) {
+		options.writeBufferSize = writeBufferSize
+	}
+}
+
+// WithMmapReads maps older segments into memory to read them without a syscall.
+func WithMmapReads(mmapReads bool) Option {
+	return func(options *Options) {
+		options.mmapReads = mmapReads
+	}
+}
+
+// WithMaxKeySize limits the size of keys, 0 for no limit.
+func WithMaxKeySize(maxKeySize int) Option {
+	return func(options *Options) {
+		options.maxKeySize = maxKeySize
+	}
+}
+
+// WithMaxValueSize limits the size of values, 0 for no limit. Values are always
+// limited to what fits in a segment together with their key.
+func WithMaxValueSize(maxValueSize int) Option {
+	return func(options *Options) {
+		options.maxValueSize = maxValueSize
+	}
+}
+
+// WithBlobThreshold writes values of at least blobThreshold bytes, after
+// compression, to a separate blob log, so merge does not copy them. 0 disables it.
+func WithBlobThreshold(blobThreshold int) Option {
+	return func(options *Options) {
+		options.blobThreshold = blobThreshold
+	}
+}
+
+// WithBlobGarbageRatio sets the garbage ratio at which a blob segment is compacted.
+func WithBlobGarbageRatio(blobGarbageRatio float64) Option {
+	return func(options *Options) {
+		options.blobGarbageRatio = blobGarbageRatio
+	}
+}
+
+// WithMergeInteval sets how often the garbage ratios are checked to decide whether
+// to merge, 0 disables automatic merges.
 func WithMergeInteval(mergeInteval time.Duration) Option {
 	return func(options *Options) {
 		options.mergeInteval = mergeInteval
@@ -43,6 +143,87 @@ func WithMaxActiveFileSize(maxActiveFileSize int64) Option {
 	}
 }
 
+// WithSkipCorrupted makes corrupt records and wal frames be skipped with a logged
+// warning instead of failing Open, Merge and Get. A torn tail of the active
+// segment is always truncated on Open.
+func WithSkipCorrupted(skipCorrupted bool) Option {
+	return func(options *Options) {
+		options.skipCorrupted = skipCorrupted
+	}
+}
+
+// WithReadOnly opens an existing db for reading only. It takes a shared lock, so
+// several read-only processes can open the same dir while no writer has it open.
+func WithReadOnly(readOnly bool) Option {
+	return func(options *Options) {
+		options.readOnly = readOnly
+	}
+}
+
+// WithGarbageRatio merges once dead bytes make up this ratio of all segments. The
+// segments whose own ratio reaches it are compacted. A non-positive ratio disables it.
+func WithGarbageRatio(garbageRatio float64) Option {
+	return func(options *Options) {
+		options.garbageRatio = garbageRatio
+	}
+}
+
+// WithSegmentGarbageRatio merges the segments whose dead bytes reach this ratio of
+// their size. A segment reaching it is merged without waiting for the merge interval,
+// unless automatic merges are disabled. A non-positive ratio disables it.
+func WithSegmentGarbageRatio(segmentGarbageRatio float64) Option {
+	return func(options *Options) {
+		options.segmentGarbageRatio = segmentGarbageRatio
+	}
+}
+
+// WithMergeRateLimit caps the bytes merge reads and writes per second, so that it
+// runs alongside foreground reads. 0 means unlimited.
+func WithMergeRateLimit(bytesPerSec int64) Option {
+	return func(options *Options) {
+		options.mergeRateLimit = bytesPerSec
+	}
+}
+
+// WithCodec compresses the values written from now on with codec. Values already
+// written keep their codec and are still readable.
+func WithCodec(codec Codec) Option {
+	return func(options *Options) {
+		options.codec = codec
+	}
+}
+
+// WithCompressThreshold sets the smallest value size in bytes worth compressing.
+func WithCompressThreshold(compressThreshold int) Option {
+	return func(options *Options) {
+		options.compressThreshold = compressThreshold
+	}
+}
+
+// WithEncryptionKey encrypts segments written from now on with key, it is also
+// needed to read them back.
+func WithEncryptionKey(key []byte) Option {
+	return func(options *Options) {
+		options.keyProvider = wal.NewStaticKeyProvider(0, map[uint32][]byte{0: key})
+	}
+}
+
+// WithKeyProvider encrypts new segments with the current key of keyProvider and
+// decrypts segments with any key it provides, e.g. to re-key a db through merge.
+func WithKeyProvider(keyProvider wal.KeyProvider) Option {
+	return func(options *Options) {
+		options.keyProvider = keyProvider
+	}
+}
+
+// WithIndexType sets the in-memory index. Snapshots of the BTree and HashMap
+// indexes are cheap, a snapshot of the ART index copies every key under the db lock.
+func WithIndexType(indexType index.IndexType) Option {
+	return func(options *Options) {
+		options.indexType = indexType
+	}
+}
+
 func (opt *Options) GetMergeInteval() time.Duration {
 	return opt.mergeInteval
 }
@@ -59,4 +240,74 @@ func (opt *Options) GetMaxActiveFileSize() int64 {
     return opt.maxActiveFileSize
 }
 
+func (opt *Options) GetIndexType() index.IndexType {
+    return opt.indexType
+}
+
+func (opt *Options) GetSkipCorrupted() bool {
+    return opt.skipCorrupted
+}
+
+func (opt *Options) GetReadOnly() bool {
+    return opt.readOnly
+}
+
+func (opt *Options) GetGarbageRatio() float64 {
+    return opt.garbageRatio
+}
 
+func (opt *Options) GetSegmentGarbageRatio() float64 {
+    return opt.segmentGarbageRatio
+}
+
+func (opt *Options) GetMergeRateLimit() int64 {
+    return opt.mergeRateLimit
+}
+
+func (opt *Options) GetCodec() Codec {
+    return opt.codec
+}
+
+func (opt *Options) GetCompressThreshold() int {
+    return opt.compressThreshold
+}
+
+func (opt *Options) GetKeyProvider() wal.KeyProvider {
+    return opt.keyProvider
+}
+
+func (opt *Options) GetGroupCommit() bool {
+    return opt.groupCommit
+}
+
+func (opt *Options) GetSyncInterval() time.Duration {
+    return opt.syncInterval
+}
+
+func (opt *Options) GetSyncBytes() int64 {
+    return opt.syncBytes
+}
+
+func (opt *Options) GetWriteBufferSize() int {
+    return opt.writeBufferSize
+}
+
+func (opt *Options) GetMmapReads() bool {
+    return opt.mmapReads
+}
+
+func (opt *Options) GetMaxKeySize() int {
+    return opt.maxKeySize
+}
+
+func (opt *Options) GetMaxValueSize() int {
+    return opt.maxValueSize
+}
+
+func (opt *Options) GetBlobThreshold() int {
+    return opt.blobThreshold
+}
+
+func (opt *Options) GetBlobGarbageRatio() float64 {
+    return opt.blobGarbageRatio
+}
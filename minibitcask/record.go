@@ -2,21 +2,43 @@ package minibitcask
 
 import (
 	"encoding/binary"
+	"errors"
 	"hash/crc32"
+	"io"
+	"minibitcask/wal"
 	"os"
 	"time"
 )
 
 const (
-	TYPE_RECORD_PUT    uint16 = 0
-	TYPE_RECORD_DELETE uint16 = 1
-	RECORD_HEAD_SIZE   uint16 = 22
+	TYPE_RECORD_PUT            uint16 = 0
+	TYPE_RECORD_DELETE         uint16 = 1
+	TYPE_RECORD_BATCH_FINISHED uint16 = 2 // commits all records written with its batchId
+	RECORD_HEAD_SIZE           uint16 = 38
+	HINT_HEAD_SIZE             uint16 = 40
+	// RECORD_V1_FLAG is set on all records written with RECORD_HEAD_SIZE. Records
+	// without it were written before batches and TTL by the first version, with a
+	// head of RECORD_V0_HEAD_SIZE.
+	RECORD_V1_FLAG             uint16 = 0x40
+	RECORD_V0_HEAD_SIZE        uint16 = 22
+	// HINT_BLOB_FLAG is set on the key size of a hint record whose key is followed
+	// by the blob pointer of its record.
+	HINT_BLOB_FLAG             uint32 = 1 << 31
+)
+
+var (
+	// errHintCrcNotMatch is returned when a hint record fails its checksum.
+	errHintCrcNotMatch = errors.New("hint crc not match")
+	// errRecordCrcNotMatch is returned when a record is truncated or fails its checksum.
+	errRecordCrcNotMatch = errors.New("record crc not match")
 )
 
 type Record struct {
 	crc       uint32
 	ts        uint64
 	flag      uint16
+	batchId   uint64 // 0 if record is not written by a batch
+	expireAt  uint64 // unix milli, 0 if record never expires
 	keySize   uint32
 	valueSize uint32
 	key       []byte
@@ -27,14 +49,16 @@ type Hint struct {
 	crc       uint32
 	fid       uint32
 	valueSize uint32
-	valuePos  uint32
+	valuePos  uint64
 	ts        uint64
+	expireAt  uint64
 }
 
 type HintRecord struct {
 	keySize   uint32
 	hint      *Hint
 	key       []byte
+	blob      *wal.FilePos // blob pointer of the record, nil if it holds its value
 }
 
 func NewRecord(key, value []byte, recordType uint16) *Record {
@@ -45,56 +69,134 @@ func NewRecord(key, value []byte, recordType uint16) *Record {
 	res.valueSize = uint32(len(value))
 	res.ts = uint64(time.Now().UnixMilli())
 	res.flag = recordType
-	res.crc = crc32.ChecksumIEEE(res.EncodeRecord()[4:])
 	return res
 }
 
 func (r *Record) Size() uint32 {
-	return 22 + r.keySize + r.valueSize
+	return uint32(RECORD_HEAD_SIZE) + r.keySize + r.valueSize
 }
 
+// GetFlag returns the type of the record.
 func (r *Record) GetFlag() uint16 {
-	return r.flag
+	return r.flag & RECORD_TYPE_MASK
+}
+
+// GetCodec returns the codec the value is compressed with.
+func (r *Record) GetCodec() Codec {
+	return Codec(r.flag >> RECORD_CODEC_SHIFT)
+}
+
+// GetValue returns the decompressed value.
+func (r *Record) GetValue() ([]byte, error) {
+	return decompress(r.GetCodec(), r.value)
+}
+
+func (r *Record) GetBatchId() uint64 {
+	return r.batchId
+}
+
+func (r *Record) GetExpireAt() uint64 {
+	return r.expireAt
+}
+
+// IsExpired reports whether the record has expired at now, in unix milli.
+func (r *Record) IsExpired(now int64) bool {
+	return r.expireAt != 0 && r.expireAt <= uint64(now)
 }
 
+// EncodeRecord encodes a record as crc(4B) | ts(8B) | flag(2B) | batchId(8B) | expireAt(8B) | keySize(4B) | valueSize(4B) | key | value,
+// crc is computed over everything after it. flag always has RECORD_V1_FLAG set.
 func (r *Record) EncodeRecord() []byte {
 	res := make([]byte, r.Size())
-	binary.LittleEndian.PutUint32(res[0:4], r.crc)
 	binary.LittleEndian.PutUint64(res[4:12], r.ts)
-	binary.LittleEndian.PutUint16(res[12:14], r.flag)
-	binary.LittleEndian.PutUint32(res[14:18], r.keySize)
-	binary.LittleEndian.PutUint32(res[18:22], r.valueSize)
-	copy(res[22:], r.key)
-	copy(res[22+r.keySize:], r.value)
+	binary.LittleEndian.PutUint16(res[12:14], r.flag|RECORD_V1_FLAG)
+	binary.LittleEndian.PutUint64(res[14:22], r.batchId)
+	binary.LittleEndian.PutUint64(res[22:30], r.expireAt)
+	binary.LittleEndian.PutUint32(res[30:34], r.keySize)
+	binary.LittleEndian.PutUint32(res[34:38], r.valueSize)
+	copy(res[RECORD_HEAD_SIZE:], r.key)
+	copy(res[uint32(RECORD_HEAD_SIZE)+r.keySize:], r.value)
+	r.crc = crc32.ChecksumIEEE(res[4:])
+	binary.LittleEndian.PutUint32(res[0:4], r.crc)
 	return res
 }
 
-func DecodeRecord(data []byte) *Record {
+// DecodeRecord decodes a record and verifies its crc.
+func DecodeRecord(data []byte) (*Record, error) {
 	res := &Record{}
-	res.crc = binary.LittleEndian.Uint32(data[0:4])
-	res.ts = binary.LittleEndian.Uint64(data[4:12])
-	res.flag = binary.LittleEndian.Uint16(data[12:14])
-	res.keySize = binary.LittleEndian.Uint32(data[14:18])
-	res.valueSize = binary.LittleEndian.Uint32(data[18:22])
-	res.key = data[22 : 22+res.keySize]
-	res.value = data[22+res.keySize:]
-	return res
+	if err := res.decode(data); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// decode decodes data into r, key and value of r point into data.
+func (r *Record) decode(data []byte) error {
+	if len(data) < int(RECORD_V0_HEAD_SIZE) {
+		return errRecordCrcNotMatch
+	}
+
+	r.crc = binary.LittleEndian.Uint32(data[0:4])
+	r.ts = binary.LittleEndian.Uint64(data[4:12])
+	r.flag = binary.LittleEndian.Uint16(data[12:14])
+	headSize := uint32(RECORD_HEAD_SIZE)
+	if r.flag&RECORD_V1_FLAG == 0 {
+		// crc(4B) | ts(8B) | flag(2B) | keySize(4B) | valueSize(4B) | key | value
+		headSize = uint32(RECORD_V0_HEAD_SIZE)
+		r.batchId = 0
+		r.expireAt = 0
+		r.keySize = binary.LittleEndian.Uint32(data[14:18])
+		r.valueSize = binary.LittleEndian.Uint32(data[18:22])
+	} else {
+		if len(data) < int(RECORD_HEAD_SIZE) {
+			return errRecordCrcNotMatch
+		}
+		r.batchId = binary.LittleEndian.Uint64(data[14:22])
+		r.expireAt = binary.LittleEndian.Uint64(data[22:30])
+		r.keySize = binary.LittleEndian.Uint32(data[30:34])
+		r.valueSize = binary.LittleEndian.Uint32(data[34:38])
+	}
+	if uint64(len(data)) != uint64(headSize)+uint64(r.keySize)+uint64(r.valueSize) {
+		return errRecordCrcNotMatch
+	}
+	if r.crc != crc32.ChecksumIEEE(data[4:]) {
+		return errRecordCrcNotMatch
+	}
+
+	r.key = data[headSize : headSize+r.keySize]
+	r.value = data[headSize+r.keySize:]
+	return nil
+}
+
+// isV0 reports whether the record was read in the format of the first version.
+func (r *Record) isV0() bool {
+	return r.flag&RECORD_V1_FLAG == 0
 }
 
 func ReadRecord(readFile *os.File, offset int64) (*Record, error) {
 	res := make([]byte, RECORD_HEAD_SIZE)
-	_, err := readFile.ReadAt(res, offset)
-	if err != nil {
+	n, err := readFile.ReadAt(res, offset)
+	if err != nil && (err != io.EOF || n < int(RECORD_V0_HEAD_SIZE)) {
 		return nil, err
 	}
 
 	var keySize uint32
 	var valueSize uint32
-	keySize = binary.LittleEndian.Uint32(res[14:18])
-	valueSize = binary.LittleEndian.Uint32(res[18:22])
+	headSize := uint32(RECORD_HEAD_SIZE)
+	if binary.LittleEndian.Uint16(res[12:14])&RECORD_V1_FLAG == 0 {
+		headSize = uint32(RECORD_V0_HEAD_SIZE)
+		keySize = binary.LittleEndian.Uint32(res[14:18])
+		valueSize = binary.LittleEndian.Uint32(res[18:22])
+	} else {
+		if n < int(RECORD_HEAD_SIZE) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		keySize = binary.LittleEndian.Uint32(res[30:34])
+		valueSize = binary.LittleEndian.Uint32(res[34:38])
+	}
 
 	// Calculate the record length
-	recordLen := uint32(RECORD_HEAD_SIZE) + keySize + valueSize
+	recordLen := headSize + keySize + valueSize
 	recordBytes := make([]byte, recordLen)
 	// Read the record
 	_, err = readFile.ReadAt(recordBytes, offset)
@@ -102,5 +204,129 @@ func ReadRecord(readFile *os.File, offset int64) (*Record, error) {
 		return nil, err
 	}
 
-	return DecodeRecord(recordBytes), err
-}
\ No newline at end of file
+	return DecodeRecord(recordBytes)
+}
+
+func NewHintRecord(key []byte, walPos wal.WalPos, ts uint64, expireAt uint64, blob *wal.FilePos) *HintRecord {
+	res := &HintRecord{}
+	res.key = key
+	res.keySize = uint32(len(key))
+	res.blob = blob
+	res.hint = &Hint{
+		fid:       walPos.GetFileFid(),
+		valueSize: uint32(walPos.GetValueSize()),
+		valuePos:  uint64(walPos.GetOffset()),
+		ts:        ts,
+		expireAt:  expireAt,
+	}
+	res.hint.crc = crc32.ChecksumIEEE(res.EncodeHintRecord()[4:])
+	return res
+}
+
+func (hr *HintRecord) Size() uint32 {
+	if hr.blob != nil {
+		return uint32(HINT_HEAD_SIZE) + hr.keySize + BLOB_POINTER_SIZE
+	}
+	return uint32(HINT_HEAD_SIZE) + hr.keySize
+}
+
+func (hr *HintRecord) GetWalPos() wal.WalPos {
+	return &wal.FilePos{Fid: hr.hint.fid, Offset: int64(hr.hint.valuePos), ValueSize: int64(hr.hint.valueSize)}
+}
+
+func (hr *HintRecord) GetExpireAt() uint64 {
+	return hr.hint.expireAt
+}
+
+// GetBlob returns the blob pointer of the record, nil if the record holds its value.
+func (hr *HintRecord) GetBlob() *wal.FilePos {
+	return hr.blob
+}
+
+// EncodeHintRecord encodes a hint record as crc(4B) | ts(8B) | fid(4B) | valuePos(8B) | valueSize(4B) | expireAt(8B) | keySize(4B) | key | blob pointer(20B),
+// the blob pointer is only present if the key size has HINT_BLOB_FLAG set.
+func (hr *HintRecord) EncodeHintRecord() []byte {
+	res := make([]byte, hr.Size())
+	binary.LittleEndian.PutUint32(res[0:4], hr.hint.crc)
+	binary.LittleEndian.PutUint64(res[4:12], hr.hint.ts)
+	binary.LittleEndian.PutUint32(res[12:16], hr.hint.fid)
+	binary.LittleEndian.PutUint64(res[16:24], hr.hint.valuePos)
+	binary.LittleEndian.PutUint32(res[24:28], hr.hint.valueSize)
+	binary.LittleEndian.PutUint64(res[28:36], hr.hint.expireAt)
+	keySize := hr.keySize
+	if hr.blob != nil {
+		keySize |= HINT_BLOB_FLAG
+		copy(res[uint32(HINT_HEAD_SIZE) + hr.keySize:], encodeBlobPointer(hr.blob))
+	}
+	binary.LittleEndian.PutUint32(res[36:40], keySize)
+	copy(res[HINT_HEAD_SIZE:], hr.key)
+	return res
+}
+
+// DecodeHintRecord decodes the hint record at the head of data and returns it
+// together with the number of bytes it occupies.
+func DecodeHintRecord(data []byte) (*HintRecord, int, error) {
+	if len(data) < int(HINT_HEAD_SIZE) {
+		return nil, 0, errHintCrcNotMatch
+	}
+
+	res := &HintRecord{hint: &Hint{}}
+	res.hint.crc = binary.LittleEndian.Uint32(data[0:4])
+	res.hint.ts = binary.LittleEndian.Uint64(data[4:12])
+	res.hint.fid = binary.LittleEndian.Uint32(data[12:16])
+	res.hint.valuePos = binary.LittleEndian.Uint64(data[16:24])
+	res.hint.valueSize = binary.LittleEndian.Uint32(data[24:28])
+	res.hint.expireAt = binary.LittleEndian.Uint64(data[28:36])
+	res.keySize = binary.LittleEndian.Uint32(data[36:40])
+	hasBlob := res.keySize&HINT_BLOB_FLAG != 0
+	res.keySize &^= HINT_BLOB_FLAG
+
+	size := int(HINT_HEAD_SIZE) + int(res.keySize)
+	if hasBlob {
+		size += BLOB_POINTER_SIZE
+	}
+	if len(data) < size {
+		return nil, 0, errHintCrcNotMatch
+	}
+	if res.hint.crc != crc32.ChecksumIEEE(data[4:size]) {
+		return nil, 0, errHintCrcNotMatch
+	}
+	res.key = data[HINT_HEAD_SIZE:int(HINT_HEAD_SIZE) + int(res.keySize)]
+	if hasBlob {
+		blob := decodeBlobPointer(data[size - BLOB_POINTER_SIZE:size])
+		res.blob = &blob
+	}
+
+	return res, size, nil
+}
+
+// ReadHintFile reads and verifies all hint records in a hint file. It fails with
+// errHintCrcNotMatch if the file or any of its records does not match its checksum.
+func ReadHintFile(path string) ([]*HintRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file ends with crc(4B) of all hint records
+	if len(data) < 4 {
+		return nil, errHintCrcNotMatch
+	}
+	footer := len(data) - 4
+	if binary.LittleEndian.Uint32(data[footer:]) != crc32.ChecksumIEEE(data[:footer]) {
+		return nil, errHintCrcNotMatch
+	}
+	data = data[:footer]
+
+	var res []*HintRecord
+	for len(data) > 0 {
+		hr, n, err := DecodeHintRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, hr)
+		data = data[n:]
+	}
+
+	return res, nil
+}
@@ -0,0 +1,101 @@
+package minibitcask
+
+import (
+	"minibitcask/index"
+	"time"
+)
+
+// Snapshot is a read-only view of the db as of the write with its sequence number.
+// The segments it reads from are not merged until it is released.
+type Snapshot struct {
+	db      *DB
+	data    index.Indexer
+	seq     uint64
+	fid     uint32 // segments up to fid are pinned
+	blobFid uint32 // blob segments up to blobFid are pinned if hasBlob
+	hasBlob bool
+}
+
+// Snapshot returns a snapshot of the current state of db, it must be released
+// once it is no longer used.
+func (db *DB) Snapshot() *Snapshot {
+	db.rwLock.Lock()
+	defer db.rwLock.Unlock()
+
+	s := &Snapshot{
+		db:   db,
+		data: db.data.Clone(),
+		seq:  db.seq,
+		fid:  db.wal.ActiveFid(),
+	}
+	if db.blobWal != nil {
+		s.blobFid, s.hasBlob = db.blobWal.ActiveFid(), true
+	}
+	db.snapshots[s] = struct{}{}
+	return s
+}
+
+// Seq returns the sequence number of the last write the snapshot sees. Writes are
+// numbered in the order they are applied since the db was opened.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	walPos := s.data.Get(key)
+	if walPos == nil || isExpired(walPos, time.Now().UnixMilli()) {
+		return nil, ErrKeyNotFound
+	}
+	return s.db.readValue(walPos)
+}
+
+// NewIterator iterates over the keys of the snapshot.
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	it := newIterator(s.db, s.data, opts)
+	it.snapshot = s
+	return it
+}
+
+// Release unpins the segments of the snapshot, it must not be used afterwards.
+func (s *Snapshot) Release() {
+	s.db.rwLock.Lock()
+	defer s.db.rwLock.Unlock()
+	delete(s.db.snapshots, s)
+}
+
+// pinnedFids returns the highest segment and blob segment fids pinned by open
+// snapshots, all segments up to them must be kept. db lock must be held.
+func (db *DB) pinnedFids() (fid uint32, blobFid uint32, pinned bool, blobPinned bool) {
+	for s := range db.snapshots {
+		if !pinned || s.fid > fid {
+			fid, pinned = s.fid, true
+		}
+		if s.hasBlob && (!blobPinned || s.blobFid > blobFid) {
+			blobFid, blobPinned = s.blobFid, true
+		}
+	}
+	return fid, blobFid, pinned, blobPinned
+}
+
+// unpinnedRuns removes the segments pinned by snapshots from runs.
+func (db *DB) unpinnedRuns(runs [][]uint32) [][]uint32 {
+	db.rwLock.RLock()
+	defer db.rwLock.RUnlock()
+
+	fid, _, pinned, _ := db.pinnedFids()
+	if !pinned {
+		return runs
+	}
+
+	var res [][]uint32
+	for _, run := range runs {
+		// runs are sorted, pinned segments are at their head
+		for len(run) > 0 && run[0] <= fid {
+			run = run[1:]
+		}
+		if len(run) > 0 {
+			res = append(res, run)
+		}
+	}
+	return res
+}
@@ -0,0 +1,88 @@
+package minibitcask
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// syncer syncs the wal in the background every interval or once bytes are
+// written since the last sync, whichever comes first.
+type syncer struct {
+	db       *DB
+	interval time.Duration
+	bytes    int64
+	unsynced int64 // bytes written since the last sync
+	notifyCh chan struct{}
+	closeCh  chan struct{}
+	doneCh   chan struct{}
+}
+
+func newSyncer(db *DB) *syncer {
+	s := &syncer{
+		db:       db,
+		interval: db.opt.syncInterval,
+		bytes:    db.opt.syncBytes,
+		notifyCh: make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// written counts n bytes written to the wal and wakes up the syncer if enough
+// bytes are unsynced.
+func (s *syncer) written(n int64) {
+	if atomic.AddInt64(&s.unsynced, n) < s.bytes || s.bytes <= 0 {
+		return
+	}
+
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *syncer) run() {
+	defer close(s.doneCh)
+
+	var tickCh <-chan time.Time
+	if s.interval > 0 {
+		tick := time.NewTicker(s.interval)
+		defer tick.Stop()
+		tickCh = tick.C
+	}
+
+	for {
+		select {
+		case <-tickCh:
+		case <-s.notifyCh:
+		case <-s.closeCh:
+			return
+		}
+
+		if err := s.sync(); err != nil {
+			log.Printf("background sync error: %v\n", err)
+		}
+	}
+}
+
+func (s *syncer) sync() error {
+	if atomic.SwapInt64(&s.unsynced, 0) == 0 {
+		return nil
+	}
+	if s.db.blobWal != nil {
+		if err := s.db.blobWal.Sync(); err != nil {
+			return err
+		}
+	}
+	return s.db.wal.Sync()
+}
+
+// close stops the syncer and syncs what is left.
+func (s *syncer) close() error {
+	close(s.closeCh)
+	<-s.doneCh
+	return s.sync()
+}
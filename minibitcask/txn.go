@@ -0,0 +1,153 @@
+package minibitcask
+
+import (
+	"minibitcask/wal"
+	"time"
+)
+
+// Txn is an optimistic transaction. Its writes are buffered and committed as one
+// batch. Commit fails with ErrTxnConflict if a key it read has been written since.
+// A Txn is not safe for concurrent use.
+type Txn struct {
+	db        *DB
+	readWrite bool
+	reads     map[string]wal.WalPos // index position of each read key, nil if it did not exist
+	writes    map[string]*Record
+	done      bool
+}
+
+// Begin starts a transaction, only read-write ones can write.
+func (db *DB) Begin(readWrite bool) (*Txn, error) {
+	if readWrite && db.opt.readOnly {
+		return nil, ErrReadOnly
+	}
+	return &Txn{
+		db:        db,
+		readWrite: readWrite,
+		reads:     make(map[string]wal.WalPos),
+		writes:    make(map[string]*Record),
+	}, nil
+}
+
+// Get returns the value of key, including the writes of the transaction.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+
+	if r, ok := txn.writes[string(key)]; ok {
+		if r.GetFlag() == TYPE_RECORD_DELETE {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte(nil), r.value...), nil
+	}
+
+	db := txn.db
+	db.rwLock.RLock()
+	defer db.rwLock.RUnlock()
+
+	walPos := db.data.Get(key)
+	if walPos != nil && isExpired(walPos, time.Now().UnixMilli()) {
+		walPos = nil
+	}
+	// the first read is the version checked on commit
+	if _, ok := txn.reads[string(key)]; !ok {
+		txn.reads[string(key)] = walPos
+	}
+	if walPos == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return db.readValue(walPos)
+}
+
+func (txn *Txn) Put(key, value []byte) error {
+	if err := txn.checkWrite(key, value, false); err != nil {
+		return err
+	}
+
+	// key and value are written on commit, copy them in case the caller reuses them
+	key = append([]byte(nil), key...)
+	value = append([]byte(nil), value...)
+	txn.writes[string(key)] = NewRecord(key, value, TYPE_RECORD_PUT)
+	return nil
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	if err := txn.checkWrite(key, nil, true); err != nil {
+		return err
+	}
+
+	key = append([]byte(nil), key...)
+	txn.writes[string(key)] = NewRecord(key, []byte(""), TYPE_RECORD_DELETE)
+	return nil
+}
+
+func (txn *Txn) checkWrite(key, value []byte, del bool) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if !txn.readWrite {
+		return ErrTxnReadOnly
+	}
+	if del {
+		return txn.db.checkKey(key)
+	}
+	return txn.db.checkKeyValue(key, value)
+}
+
+// Commit writes the writes of the transaction atomically, unless a key it read has
+// been written since. A transaction without writes still fails with ErrTxnConflict
+// then, as its reads may not have seen one state of the db.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+
+	db := txn.db
+	if len(txn.writes) == 0 {
+		db.rwLock.RLock()
+		defer db.rwLock.RUnlock()
+		return txn.checkReads()
+	}
+
+	return db.write(func() error {
+		if err := txn.checkReads(); err != nil {
+			return err
+		}
+
+		records := make([]*Record, 0, len(txn.writes))
+		for _, r := range txn.writes {
+			records = append(records, r)
+		}
+		return db.writeBatch(records)
+	})
+}
+
+// checkReads returns ErrTxnConflict if a key read by the transaction has been
+// written since, the db lock must be held.
+func (txn *Txn) checkReads() error {
+	db := txn.db
+	now := time.Now().UnixMilli()
+	for key, readPos := range txn.reads {
+		walPos := db.data.Get([]byte(key))
+		if walPos != nil && isExpired(walPos, now) {
+			walPos = nil
+		}
+		if (walPos == nil) != (readPos == nil) || (walPos != nil && indexVersion(walPos) != indexVersion(readPos)) {
+			return ErrTxnConflict
+		}
+	}
+	return nil
+}
+
+// Rollback discards the writes of the transaction.
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+	txn.writes = nil
+	return nil
+}
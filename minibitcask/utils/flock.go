@@ -0,0 +1,47 @@
+//go:build !windows && !plan9
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileLock is an advisory lock on a file held through flock(2), it is
+// released by the kernel when the process exits.
+type FileLock struct {
+	fd *os.File
+}
+
+// TryLockFile takes an exclusive lock, or a shared one if shared is true, on path
+// without blocking, creating the file if needed. It returns false if a
+// conflicting lock is held by someone else.
+func TryLockFile(path string, shared bool) (*FileLock, bool, error) {
+	flag, how := os.O_RDWR, syscall.LOCK_EX
+	if shared {
+		flag, how = os.O_RDONLY, syscall.LOCK_SH
+	}
+
+	fd, err := os.OpenFile(path, flag|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err = syscall.Flock(int(fd.Fd()), how|syscall.LOCK_NB); err != nil {
+		fd.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return &FileLock{fd: fd}, true, nil
+}
+
+func (l *FileLock) Unlock() error {
+	if err := syscall.Flock(int(l.fd.Fd()), syscall.LOCK_UN); err != nil {
+		l.fd.Close()
+		return err
+	}
+	return l.fd.Close()
+}
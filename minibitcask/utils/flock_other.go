@@ -0,0 +1,30 @@
+//go:build windows || plan9
+
+package utils
+
+import (
+	"os"
+)
+
+// FileLock only creates the lock file on platforms without flock(2), it does
+// not keep other processes out.
+type FileLock struct {
+	fd *os.File
+}
+
+func TryLockFile(path string, shared bool) (*FileLock, bool, error) {
+	flag := os.O_RDWR
+	if shared {
+		flag = os.O_RDONLY
+	}
+
+	fd, err := os.OpenFile(path, flag|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, false, err
+	}
+	return &FileLock{fd: fd}, true, nil
+}
+
+func (l *FileLock) Unlock() error {
+	return l.fd.Close()
+}
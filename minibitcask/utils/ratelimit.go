@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the throughput of some work in bytes per second. Up to one
+// second worth of bytes can be used at once.
+type RateLimiter struct {
+	rate   int64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter of rate bytes per second, a non-positive rate
+// means unlimited.
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// WaitN waits until n bytes can be used or ctx is done.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || l.rate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	// go into debt, the wait pays it back
+	l.tokens -= float64(n)
+	tokens := l.tokens
+	l.mu.Unlock()
+
+	if tokens >= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(-tokens / float64(l.rate) * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -10,6 +10,9 @@ import (
 
 const (
 	HINT_FILE_EXT = ".hint"
+	MERGE_DIR_NAME = "merge"
+	LOCK_FILE_NAME = "LOCK"
+	MERGE_FIN_FILE_NAME = "MERGEFIN"
 )
 
 func GetSegmentFilePath(dir string, fid uint32, fileExt string) string {
@@ -20,6 +23,18 @@ func GetHintFilePath(dir string, fid uint32) string {
     return dir + "/" + strconv.Itoa(int(fid)) + HINT_FILE_EXT
 }
 
+func GetLockFilePath(dir string) string {
+	return dir + "/" + LOCK_FILE_NAME
+}
+
+func GetMergeDir(dir string) string {
+	return dir + "/" + MERGE_DIR_NAME
+}
+
+func GetMergeFinFilePath(mergeDir string) string {
+	return mergeDir + "/" + MERGE_FIN_FILE_NAME
+}
+
 func Read(path string, offset int64, valueSize uint32) ([]byte, error) {
 	readFile, err := os.OpenFile(path, os.O_RDONLY, 0666)
 	if err != nil {
@@ -0,0 +1,130 @@
+package wal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// An encrypted segment starts with magic(8B) | keyId(4B) | salt(16B). Its frames hold
+// the records sealed with AES-GCM under a key derived from the master key and the
+// salt, so segments rewritten by merge under the same fid never reuse a nonce.
+const (
+	SEGMENT_MAGIC       = "MBCSEGE1"
+	SEGMENT_SALT_SIZE   = 16
+	SEGMENT_HEADER_SIZE = 8 + 4 + SEGMENT_SALT_SIZE
+	SEGMENT_TAG_SIZE    = 16 // added by AES-GCM to each frame
+)
+
+var (
+	// ErrEncryptionKey is returned when the key a segment is encrypted with is not provided.
+	ErrEncryptionKey = errors.New("encryption key not found")
+)
+
+// KeyProvider provides the master keys segments are encrypted with.
+type KeyProvider interface {
+	// CurrentKey returns the key new segments are encrypted with and its id. A nil
+	// key leaves new segments unencrypted.
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key with id.
+	Key(id uint32) ([]byte, error)
+}
+
+type staticKeyProvider struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewStaticKeyProvider returns a provider of keys by id, new segments are encrypted
+// with the key of id current.
+func NewStaticKeyProvider(current uint32, keys map[uint32][]byte) KeyProvider {
+	return &staticKeyProvider{current: current, keys: keys}
+}
+
+func (p *staticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *staticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %d: %w", id, ErrEncryptionKey)
+	}
+	return key, nil
+}
+
+// newSegmentCipher derives the AES-256-GCM cipher of a segment from the master key and its salt.
+func newSegmentCipher(key []byte, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of the frame at offset of segment fid.
+func segmentNonce(fid SegmentID, offset int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[0:4], fid)
+	binary.BigEndian.PutUint64(nonce[4:12], uint64(offset))
+	return nonce
+}
+
+// writeSegmentHeader writes the header of a new segment encrypted with the
+// current key of provider. It returns nil cipher if there is no current key.
+func writeSegmentHeader(fd *os.File, provider KeyProvider) (cipher.AEAD, error) {
+	id, key, err := provider.CurrentKey()
+	if err != nil || key == nil {
+		return nil, err
+	}
+
+	header := make([]byte, SEGMENT_HEADER_SIZE)
+	copy(header, SEGMENT_MAGIC)
+	binary.BigEndian.PutUint32(header[8:12], id)
+	if _, err = rand.Read(header[12:]); err != nil {
+		return nil, err
+	}
+
+	aead, err := newSegmentCipher(key, header[12:])
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = fd.WriteAt(header, 0); err != nil {
+		return nil, err
+	}
+	if err = fd.Sync(); err != nil {
+		return nil, err
+	}
+
+	return aead, nil
+}
+
+// readSegmentHeader reads the header of an encrypted segment. It returns nil
+// cipher if the segment is not encrypted.
+func readSegmentHeader(fd *os.File, provider KeyProvider) (cipher.AEAD, error) {
+	header := make([]byte, SEGMENT_HEADER_SIZE)
+	if _, err := fd.ReadAt(header, 0); err != nil || !bytes.Equal(header[:8], []byte(SEGMENT_MAGIC)) {
+		return nil, nil
+	}
+
+	if provider == nil {
+		return nil, ErrEncryptionKey
+	}
+	key, err := provider.Key(binary.BigEndian.Uint32(header[8:12]))
+	if err != nil {
+		return nil, err
+	}
+
+	return newSegmentCipher(key, header[12:])
+}
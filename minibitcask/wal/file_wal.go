@@ -1,11 +1,13 @@
 package wal
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"log"
 	"minibitcask/utils"
 	"os"
 	"sort"
@@ -15,12 +17,23 @@ import (
 var (
 	// ErrCrcNotMatch is returned when the key is found but the value is not valid.
 	ErrCrcNotMatch = errors.New("crc not match")
+	// ErrNoSegment is returned when a read-only wal is opened in a dir without segments.
+	ErrNoSegment = errors.New("no segment found")
 )
 
 const (
 	SEGMENT_FILE_EXT	= ".SEG"
+	BLOB_FILE_EXT	= ".BLOB"
+	FRAME_HEAD_SIZE	= 8
 )
 
+// MaxDataSize returns the size of the largest data which fits in segments of
+// segmentSize, which leaves room for the header and tag of an encrypted segment.
+// Larger data is written to a segment of its own.
+func MaxDataSize(segmentSize int64) int64 {
+	return segmentSize - SEGMENT_HEADER_SIZE - FRAME_HEAD_SIZE - SEGMENT_TAG_SIZE
+}
+
 type FilePos struct {
 	Fid	uint32
 	Offset	int64
@@ -44,6 +57,35 @@ type Segment struct {
 	fd	*os.File
 	fid	uint32  // cur fid of file
 	offset int64
+	size	int64 // readers stop at size, -1 to read up to EOF
+	aead	cipher.AEAD // nil if segment is not encrypted
+	buf	[]byte // records of the active segment not written to fd yet
+	mmap	[]byte // mapped file of an older segment, nil if it is read with pread
+}
+
+// close unmaps and closes the segment.
+func (segment *Segment) close() error {
+	if segment.mmap != nil {
+		if err := munmapFile(segment.mmap); err != nil {
+			segment.fd.Close()
+			return err
+		}
+		segment.mmap = nil
+	}
+	return segment.fd.Close()
+}
+
+// flush writes the buffered records of the segment to its file.
+func (segment *Segment) flush() error {
+	if len(segment.buf) == 0 {
+		return nil
+	}
+
+	if _, err := segment.fd.WriteAt(segment.buf, segment.offset - int64(len(segment.buf))); err != nil {
+		return err
+	}
+	segment.buf = segment.buf[:0]
+	return nil
 }
 
 type FileWal struct {
@@ -51,6 +93,11 @@ type FileWal struct {
 	activeSegment	*Segment
 	olderSegments   map[SegmentID]*Segment
 	mu	sync.RWMutex
+	truncatedSize	int64 // size of torn tail dropped on open
+	// the active segment may hold a frame lost by a crash or a failed write. Its nonce
+	// is derived from the offset which is written next, so an encrypted segment is
+	// rotated before the next write instead of sealing other data with the same nonce.
+	sealActive	bool
 }
 
 func OpenFileWal(options *Options) (Wal, error) {
@@ -68,6 +115,7 @@ func OpenFileWal(options *Options) (Wal, error) {
 type FileWalReader struct {
 	segments []*Segment
 	curSegIdx int
+	skipCorrupted bool
 }
 
 func (fwr *FileWalReader) Close() error {
@@ -87,6 +135,10 @@ func (fwr *FileWalReader) Next() ([]byte, WalPos, error) {
     }
 
 	segment := fwr.segments[fwr.curSegIdx]
+	if segment.size >= 0 && segment.offset >= segment.size {
+		fwr.curSegIdx++
+		return fwr.Next()
+	}
 
 	// read header
 	head := make([]byte, 8)
@@ -106,14 +158,37 @@ func (fwr *FileWalReader) Next() ([]byte, WalPos, error) {
 	data := make([]byte, dataSize)
 	_, err = segment.fd.ReadAt(data, segment.offset + 8)
 	if err != nil {
+		if err == io.EOF && fwr.skipCorrupted {
+			// frame is cut off, nothing after it can be read
+			log.Printf("warning: skip incomplete frame in segment %d at offset %d\n", segment.fid, segment.offset)
+			fwr.curSegIdx++
+			return fwr.Next()
+		}
 		return nil, nil, err
 	}
 
+	valueSize := int64(len(data) + 8)
 	if crc != crc32.ChecksumIEEE(data) {
+		if fwr.skipCorrupted {
+			log.Printf("warning: skip corrupt frame in segment %d at offset %d\n", segment.fid, segment.offset)
+			segment.offset += valueSize
+			return fwr.Next()
+		}
 		return nil, nil, ErrCrcNotMatch
 	}
 
-	valueSize := int64(len(data) + 8)
+	if segment.aead != nil {
+		data, err = segment.aead.Open(data[:0], segmentNonce(segment.fid, segment.offset), data, nil)
+		if err != nil {
+			if fwr.skipCorrupted {
+				log.Printf("warning: skip undecryptable frame in segment %d at offset %d\n", segment.fid, segment.offset)
+				segment.offset += valueSize
+				return fwr.Next()
+			}
+			return nil, nil, ErrCrcNotMatch
+		}
+	}
+
 	walPos := &FilePos{Fid: segment.fid, Offset: segment.offset, ValueSize: valueSize}
 
 	// update offset
@@ -123,10 +198,15 @@ func (fwr *FileWalReader) Next() ([]byte, WalPos, error) {
 }
 
 func (wal *FileWal) NewWalReader(maxFid uint32) (WalReader, error) {
-	wal.mu.RLock()
-	defer wal.mu.RUnlock()
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
 
-	fileWalReader := &FileWalReader{}
+	// readers read the file
+	if err := wal.activeSegment.flush(); err != nil {
+		return nil, err
+	}
+
+	fileWalReader := &FileWalReader{skipCorrupted: wal.options.SkipCorrupted}
 	fileWalReader.curSegIdx = 0
 
 	for fid, _ := range wal.olderSegments {
@@ -144,6 +224,8 @@ func (wal *FileWal) NewWalReader(maxFid uint32) (WalReader, error) {
 		if err != nil {
 			return nil, err
 		}
+		// do not read past the last complete frame
+		segment.size = wal.activeSegment.offset
 		fileWalReader.segments = append(fileWalReader.segments, segment)
 	}
 
@@ -155,18 +237,133 @@ func (wal *FileWal) NewWalReader(maxFid uint32) (WalReader, error) {
 	return fileWalReader, nil
 }
 
+func (wal *FileWal) NewSegmentReader(fid SegmentID) (WalReader, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	// readers read the file
+	if err := wal.activeSegment.flush(); err != nil {
+		return nil, err
+	}
+
+	segment, err := wal.openSegment(fid, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	if fid == wal.activeSegment.fid {
+		segment.size = wal.activeSegment.offset
+	}
+
+	return &FileWalReader{segments: []*Segment{segment}, skipCorrupted: wal.options.SkipCorrupted}, nil
+}
+
+func (wal *FileWal) LoadSegment(fid SegmentID) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if fid == wal.activeSegment.fid {
+		return fmt.Errorf("segment %d is active", fid)
+	}
+
+	segment, err := wal.openSegment(fid, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	if err = wal.mmapSegment(segment); err != nil {
+		segment.fd.Close()
+		return err
+	}
+
+	// close the replaced segment
+	if old, ok := wal.olderSegments[fid]; ok {
+		old.close()
+	}
+	wal.olderSegments[fid] = segment
+
+	return nil
+}
+
+func (wal *FileWal) RemoveSegment(fid SegmentID) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if fid == wal.activeSegment.fid {
+		return fmt.Errorf("segment %d is active", fid)
+	}
+
+	if segment, ok := wal.olderSegments[fid]; ok {
+		if err := segment.close(); err != nil {
+			return err
+		}
+		delete(wal.olderSegments, fid)
+	}
+
+	err := os.Remove(utils.GetSegmentFilePath(wal.options.DirPath, fid, wal.options.SegmentFileExt))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
 func (wal *FileWal) openSegment(fid SegmentID, flag int) (*Segment, error) {
-	segment := &Segment{id: fid, fid: fid, offset: 0}
+	segment := &Segment{id: fid, fid: fid, offset: 0, size: -1}
 	var err error
-	segment.fd, err = os.OpenFile(utils.GetSegmentFilePath(wal.options.DirPath, fid, SEGMENT_FILE_EXT), flag, 0666)
+	segment.fd, err = os.OpenFile(utils.GetSegmentFilePath(wal.options.DirPath, fid, wal.options.SegmentFileExt), flag, 0666)
 	if err != nil {
 		fmt.Println("open segment file error:", err)
 		return nil, err
 	}
 
+	if err = wal.initSegmentCipher(segment, flag); err != nil {
+		segment.fd.Close()
+		return nil, err
+	}
+	if segment.aead != nil {
+		segment.offset = SEGMENT_HEADER_SIZE
+	}
+
 	return segment, nil
 }
 
+// mmapSegment maps an older segment if mmap reads are enabled.
+func (wal *FileWal) mmapSegment(segment *Segment) error {
+	if !wal.options.MmapReads {
+		return nil
+	}
+
+	stat, err := segment.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 {
+		return nil
+	}
+
+	segment.mmap, err = mmapFile(segment.fd, stat.Size())
+	return err
+}
+
+// initSegmentCipher sets up the cipher of an encrypted segment. A new segment is
+// encrypted with the current key if a key provider is set.
+func (wal *FileWal) initSegmentCipher(segment *Segment, flag int) error {
+	provider := wal.options.KeyProvider
+	if provider != nil && flag&os.O_CREATE != 0 {
+		stat, err := segment.fd.Stat()
+		if err != nil {
+			return err
+		}
+		if stat.Size() == 0 {
+			segment.aead, err = writeSegmentHeader(segment.fd, provider)
+			return err
+		}
+	}
+
+	var err error
+	segment.aead, err = readSegmentHeader(segment.fd, provider)
+	return err
+}
+
 func (wal *FileWal) Open(opt *Options) error {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
@@ -177,32 +374,140 @@ func (wal *FileWal) Open(opt *Options) error {
 		return err
 	}
 
+	flag := os.O_RDWR|os.O_CREATE
+	if opt.ReadOnly {
+		flag = os.O_RDONLY
+	}
+
 	if len(fids) == 0 {
-		fids = append(fids, 0)
+		if opt.ReadOnly {
+			return ErrNoSegment
+		}
+		fids = append(fids, opt.StartFid)
 	}
 
 	for i, fid := range fids {
-		segment, err := wal.openSegment(fid, os.O_RDWR|os.O_CREATE)
+		segment, err := wal.openSegment(fid, flag)
 		if err != nil {
 			return err
 		}
 
 		if i != (len(fids) - 1) {
+			if err = wal.mmapSegment(segment); err != nil {
+				segment.fd.Close()
+				return err
+			}
 			wal.olderSegments[fid] = segment
 		} else {
-			offset, err := segment.fd.Seek(0, io.SeekEnd)
+			// the process may have died in the middle of a write, drop the torn tail
+			offset, err := wal.recoverSegment(segment)
 			if err != nil {
 				return err
 			}
+			// a crash may have torn the header of a new encrypted segment, which then
+			// reads as an empty plain one and must not be written in plain text
+			provider := wal.options.KeyProvider
+			if offset == 0 && segment.aead == nil && provider != nil && !opt.ReadOnly {
+				if segment.aead, err = writeSegmentHeader(segment.fd, provider); err != nil {
+					return err
+				}
+				if segment.aead != nil {
+					offset = SEGMENT_HEADER_SIZE
+				}
+			}
 			segment.offset = offset
 			wal.activeSegment = segment
+			wal.sealActive = wal.truncatedSize > 0 && segment.aead != nil
 		}
 	}
 
 	return nil
 }
 
+// recoverSegment finds the end of the last complete frame in segment and truncates
+// the partial frame after it. Corrupt frames before the tail are left to readers.
+func (wal *FileWal) recoverSegment(segment *Segment) (int64, error) {
+	stat, err := segment.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := stat.Size()
+
+	offset := segment.offset
+	head := make([]byte, 8)
+	for size - offset >= 8 {
+		if _, err := segment.fd.ReadAt(head, offset); err != nil {
+			return 0, err
+		}
+
+		end := offset + 8 + int64(binary.BigEndian.Uint32(head[4:8]))
+		if end > size {
+			break
+		}
+
+		// the last frame may have its full size but not all of its data
+		if end == size {
+			data := make([]byte, end - offset - 8)
+			if _, err := segment.fd.ReadAt(data, offset + 8); err != nil {
+				return 0, err
+			}
+			if binary.BigEndian.Uint32(head[:4]) != crc32.ChecksumIEEE(data) {
+				break
+			}
+		}
+
+		offset = end
+	}
+
+	if offset < size {
+		wal.truncatedSize = size - offset
+		if wal.options.ReadOnly {
+			log.Printf("ignore torn tail of segment %d: %d bytes\n", segment.fid, wal.truncatedSize)
+			return offset, nil
+		}
+
+		if err := segment.fd.Truncate(offset); err != nil {
+			return 0, err
+		}
+		log.Printf("truncate torn tail of segment %d: %d bytes dropped\n", segment.fid, wal.truncatedSize)
+	}
+
+	return offset, nil
+}
+
+func (wal *FileWal) TruncatedSize() int64 {
+	return wal.truncatedSize
+}
+
+func (wal *FileWal) ActiveFid() SegmentID {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	return wal.activeSegment.fid
+}
+
 func (wal *FileWal) OpenNewActiveSegment() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.rotate(wal.activeSegment.fid + 1)
+}
+
+func (wal *FileWal) ReserveFids(n SegmentID) (SegmentID, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	first := wal.activeSegment.fid + 1
+	if err := wal.rotate(first + n); err != nil {
+		return 0, err
+	}
+	return first, nil
+}
+
+// rotate seals the active segment and opens segment fid, wal.mu must be held.
+func (wal *FileWal) rotate(fid SegmentID) error {
+	if err := wal.activeSegment.flush(); err != nil {
+		return err
+	}
+
 	// sync file
 	err := wal.activeSegment.fd.Sync()
 	if err != nil {
@@ -210,26 +515,40 @@ func (wal *FileWal) OpenNewActiveSegment() error {
 	}
 
 	// open new segment file
-	segment, err := wal.openSegment(wal.activeSegment.fid + 1, os.O_RDWR|os.O_CREATE)
+	segment, err := wal.openSegment(fid, os.O_RDWR|os.O_CREATE)
 	if err != nil {
 		return err
 	}
 
+	// the sealed segment is not written anymore
+	if err = wal.mmapSegment(wal.activeSegment); err != nil {
+		segment.fd.Close()
+		return err
+	}
+
 	// rotate segment file
 	wal.olderSegments[wal.activeSegment.id] = wal.activeSegment
 	wal.activeSegment = segment
+	wal.sealActive = false
 
 	return nil
 }
 
 func (wal *FileWal) Close() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if err := wal.activeSegment.flush(); err != nil {
+		return err
+	}
+
 	// close file
 	if err := wal.activeSegment.fd.Close(); err != nil {
 		return err
 	}
 
 	for _, segment := range wal.olderSegments {
-		if err := segment.fd.Close(); err != nil {
+		if err := segment.close(); err != nil {
 			return err
 		}
 	}
@@ -238,7 +557,26 @@ func (wal *FileWal) Close() error {
 }
 
 func (wal *FileWal) isFull(data []byte) bool {
-	return wal.activeSegment.offset + int64(len(data)) > wal.options.SegmentSize
+	if wal.options.EndFid != 0 && wal.activeSegment.fid >= wal.options.EndFid {
+		return false
+	}
+	// data larger than a segment is written to an empty one instead of rotating
+	// to a new segment on every write
+	segment := wal.activeSegment
+	if segment.offset == 0 || (segment.aead != nil && segment.offset == SEGMENT_HEADER_SIZE) {
+		return false
+	}
+	return segment.offset + int64(len(data)) > wal.options.SegmentSize
+}
+
+// encodeFrame seals data if the active segment is encrypted and frames it to be
+// written at the end of the active segment.
+func (wal *FileWal) encodeFrame(data []byte) []byte {
+	segment := wal.activeSegment
+	if segment.aead != nil {
+		data = segment.aead.Seal(nil, segmentNonce(segment.fid, segment.offset), data, nil)
+	}
+	return NewLogRecord(data).Encode()
 }
 
 func (wal *FileWal) Write(data []byte) (WalPos, error) {
@@ -246,35 +584,53 @@ func (wal *FileWal) Write(data []byte) (WalPos, error) {
 	defer wal.mu.Unlock()
 
 	// generate logRecord: crc(4B) | length(4B) | data
-	logRecordData := NewLogRecord(data).Encode()
+	logRecordData := wal.encodeFrame(data)
 
 	// rotate file if needed
-	if wal.isFull(logRecordData) {
-		err := wal.OpenNewActiveSegment()
+	if wal.sealActive || wal.isFull(logRecordData) {
+		err := wal.rotate(wal.activeSegment.fid + 1)
 		if err != nil {
 			return nil, err
 		}
+		// nonce depends on the segment
+		logRecordData = wal.encodeFrame(data)
 	}
 
-	// write logRecord data to file
-	_, err := wal.activeSegment.fd.WriteAt(logRecordData, wal.activeSegment.offset)
-	if err != nil {
-		return nil, err
-	}
-
-	// sync data if syncEnabled is enabled
-	if wal.options.SyncEnabled {
-		err = wal.activeSegment.fd.Sync()
+	segment := wal.activeSegment
+	if wal.options.WriteBufferSize > 0 {
+		segment.buf = append(segment.buf, logRecordData...)
+	} else {
+		// write logRecord data to file
+		_, err := segment.fd.WriteAt(logRecordData, segment.offset)
 		if err != nil {
+			wal.sealActive = segment.aead != nil
 			return nil, err
 		}
 	}
 
 	// get write file position and return
-	filePos := &FilePos{Fid: wal.activeSegment.fid, Offset: wal.activeSegment.offset, ValueSize: int64(len(logRecordData))}
+	filePos := &FilePos{Fid: segment.fid, Offset: segment.offset, ValueSize: int64(len(logRecordData))}
 
 	// update write offset
-	wal.activeSegment.offset += int64(len(logRecordData))
+	segment.offset += int64(len(logRecordData))
+
+	// buffer is written once it is full, or right away to be synced
+	if len(segment.buf) >= wal.options.WriteBufferSize || wal.options.SyncEnabled {
+		if err := segment.flush(); err != nil {
+			segment.offset -= int64(len(logRecordData))
+			segment.buf = segment.buf[:len(segment.buf) - len(logRecordData)]
+			wal.sealActive = segment.aead != nil
+			return nil, err
+		}
+	}
+
+	// sync data if syncEnabled is enabled
+	if wal.options.SyncEnabled {
+		err := segment.fd.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
 
     return filePos, nil
 }
@@ -283,33 +639,114 @@ func (wal *FileWal) Read(pos WalPos) ([]byte, error) {
 	wal.mu.RLock()
 	defer wal.mu.RUnlock()
 
-	// get target segment
-	var segment *Segment
-	if pos.GetFileFid() == wal.activeSegment.fid {
-		segment = wal.activeSegment
-	} else {
-		segment = wal.olderSegments[pos.GetFileFid()]
-	}
+	segment := wal.segment(pos.GetFileFid())
 
 	//  read logRecord data according to pos
 	logRecordBytes := make([]byte, pos.GetValueSize())
 
-	_, err := segment.fd.ReadAt(logRecordBytes, pos.GetOffset())
+	// records in the write buffer or the segment map are copied from memory
+	if frame := segment.frame(pos); frame != nil {
+		copy(logRecordBytes, frame)
+	} else {
+		_, err := segment.fd.ReadAt(logRecordBytes, pos.GetOffset())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return segment.openFrame(pos, logRecordBytes)
+}
+
+// View calls fn with the data at pos. The data is borrowed from the segment map,
+// the write buffer or a pooled buffer and is only valid until fn returns. The wal
+// can not be written until fn returns.
+func (wal *FileWal) View(pos WalPos, fn func(data []byte) error) error {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	segment := wal.segment(pos.GetFileFid())
+
+	frame := segment.frame(pos)
+	if frame == nil {
+		bufp := framePool.Get().(*[]byte)
+		defer framePool.Put(bufp)
+
+		if int64(cap(*bufp)) < pos.GetValueSize() {
+			*bufp = make([]byte, pos.GetValueSize())
+		}
+		frame = (*bufp)[:pos.GetValueSize()]
+		if _, err := segment.fd.ReadAt(frame, pos.GetOffset()); err != nil {
+			return err
+		}
+	}
+
+	data, err := segment.openFrame(pos, frame)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return fn(data)
+}
+
+// framePool holds the buffers View reads frames into.
+var framePool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
 
+// segment returns the segment of fid, wal.mu must be held.
+func (wal *FileWal) segment(fid SegmentID) *Segment {
+	if fid == wal.activeSegment.fid {
+		return wal.activeSegment
+	}
+	return wal.olderSegments[fid]
+}
+
+// frame returns the frame at pos if it is in memory, in the write buffer or the
+// segment map, and nil if it must be read from the file.
+func (segment *Segment) frame(pos WalPos) []byte {
+	offset, size := pos.GetOffset(), pos.GetValueSize()
+	if flushed := segment.offset - int64(len(segment.buf)); len(segment.buf) > 0 && offset >= flushed {
+		return segment.buf[offset - flushed : offset - flushed + size]
+	}
+	if segment.mmap != nil && offset + size <= int64(len(segment.mmap)) {
+		return segment.mmap[offset : offset + size]
+	}
+	return nil
+}
+
+// openFrame checks the crc of the frame at pos and returns its data, decrypted
+// if the segment is encrypted.
+func (segment *Segment) openFrame(pos WalPos, frame []byte) ([]byte, error) {
 	// decode logRecord and return data
-	logRecord := Decode(logRecordBytes)
+	logRecord := Decode(frame)
 
 	// check crc
 	if logRecord.crc != crc32.ChecksumIEEE(logRecord.data) {
 		return nil, ErrCrcNotMatch
 	}
 
+	if segment.aead != nil {
+		data, err := segment.aead.Open(nil, segmentNonce(pos.GetFileFid(), pos.GetOffset()), logRecord.data, nil)
+		if err != nil {
+			return nil, ErrCrcNotMatch
+		}
+		return data, nil
+	}
+
 	return logRecord.data, nil
 }
 
 func (wal *FileWal) Sync() error {
-    return wal.activeSegment.fd.Sync()
+	// segments are synced when they are rotated, so only the active one needs it
+	wal.mu.Lock()
+	fd := wal.activeSegment.fd
+	err := wal.activeSegment.flush()
+	wal.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return fd.Sync()
 }
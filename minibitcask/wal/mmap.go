@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the first size bytes of fd read-only.
+func mmapFile(fd *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(fd.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
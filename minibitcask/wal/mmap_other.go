@@ -0,0 +1,16 @@
+//go:build windows || plan9
+
+package wal
+
+import (
+	"os"
+)
+
+// mmapFile is not supported on this platform, segments are read with pread.
+func mmapFile(fd *os.File, size int64) ([]byte, error) {
+	return nil, nil
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
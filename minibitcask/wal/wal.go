@@ -12,6 +12,20 @@ type Options struct {
 	SegmentSize	int64
 	SegmentFileExt	string
 	SyncEnabled	bool
+	// SkipCorrupted makes readers skip frames which fail their crc instead of failing.
+	SkipCorrupted	bool
+	// ReadOnly opens existing segments for reading only, nothing is created or truncated.
+	ReadOnly	bool
+	// StartFid is the fid of the first segment created in an empty dir.
+	StartFid	SegmentID
+	// EndFid is the last fid rotated to, its segment grows beyond SegmentSize. 0 for no limit.
+	EndFid	SegmentID
+	// KeyProvider encrypts new segments with its current key and decrypts encrypted ones, nil if not encrypted.
+	KeyProvider	KeyProvider
+	// WriteBufferSize buffers writes to the active segment up to this size, 0 writes each record right away.
+	WriteBufferSize	int
+	// MmapReads maps older segments read-only so reads from them copy from memory instead of pread.
+	MmapReads	bool
 }
 
 type WalPos interface {
@@ -32,9 +46,25 @@ type Wal interface {
 	Write(data []byte) (WalPos, error)
 	// Read reads a data from the log.
 	Read(pos WalPos) ([]byte, error)
+	// View calls fn with the data at pos, which is only valid until fn returns.
+	View(pos WalPos, fn func(data []byte) error) error
 	OpenNewActiveSegment() error
+	// ReserveFids seals the active segment and opens the next one n fids further.
+	// It returns the first of the n fids skipped, which are left to the caller.
+	ReserveFids(n SegmentID) (SegmentID, error)
 	Sync() error
 	NewWalReader(maxFid uint32) (WalReader, error)
+	// NewSegmentReader returns a reader over a single segment.
+	NewSegmentReader(fid SegmentID) (WalReader, error)
+	// LoadSegment (re)opens an older segment file, e.g. after merge replaced it.
+	LoadSegment(fid SegmentID) error
+	// RemoveSegment closes an older segment and deletes its file.
+	RemoveSegment(fid SegmentID) error
+	// TruncatedSize returns the size of the torn tail dropped from the active segment
+	// on open, or ignored if the wal is read-only.
+	TruncatedSize() int64
+	// ActiveFid returns the fid of the active segment.
+	ActiveFid() SegmentID
 }
 
 type LogRecord struct {